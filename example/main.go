@@ -20,14 +20,12 @@ func blankFunc(_ *fsm.ExecutionContext) (fsm.NodeName, error) {
 	return "", errors.New("keq")
 }
 
-func sec(_ *fsm.ExecutionContext) (fsm.NodeName, error) {
-	time.Sleep(time.Second * 10)
-	return "Second", nil
+func sec(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+	return ec.ContinueAfter("Second", time.Second*10), nil
 }
 
-func fourth(_ *fsm.ExecutionContext) (fsm.NodeName, error) {
-	time.Sleep(time.Second * 10)
-	return "Fourth", nil
+func fourth(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+	return ec.ContinueAfter("Fourth", time.Second*10), nil
 }
 
 func NewRedisPool() (*redis.Pool, error) {
@@ -65,7 +63,7 @@ func main() {
 	stepMap.AddStep("Second", []fsm.NodeName{"Fourth", "Fifth"}, fourth)
 	stepMap.AddStep("Third", []fsm.NodeName{"Sixth", "Seventh"}, blankFunc)
 
-	mongo, err := storage.NewMongoStorage(config.MongodbConfig{
+	mongo, err := storage.NewMongoStorage(storage.MongodbConfig{
 		Url: "localhost",
 		Database: "fsm",
 		Table: "sample_executor",
@@ -91,9 +89,14 @@ func main() {
 		QueueNamespace: "test",
 		RedisPool: rp,
 	})
+	executor.SetScheduler(queue.NewScheduler(config.Scheduler{
+		Enqueuer: eq,
+		QueueJobName: "super_job",
+	}))
 	handler := queue.NewHandler(config.Handler{
 		QueueNamespace: "test",
 		QueueJobName: "super_job",
+		ExecutorChannels: executor.Channels(),
 	})
 	handler.Start()
 	defer func() {
@@ -105,10 +108,18 @@ func main() {
 		Enqueuer: eq,
 		Repository: mongo,
 		JobStack: executor.GetJobStack(),
+		GraphExporter: executor,
+		JobCanceller: executor,
+		Limits: executor,
+		Simulator: executor,
 		QueueJobName: "super_job",
 	})
 	go executor.StartProcessing()
 
+	if _, err := executor.RecoverJobs(); err != nil {
+		log.Println(err)
+	}
+
 	log.Println("Listening on 0.0.0.0:8086")
 	log.Fatal(rec.ListenAndServe())
 }
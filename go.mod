@@ -11,4 +11,5 @@ require (
 	github.com/pkg/errors v0.9.1
 	github.com/robfig/cron v1.2.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20200902074654-038fdea0a05b // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
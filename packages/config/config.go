@@ -5,21 +5,17 @@ import (
 	"github.com/Madamas/fsm-orchestrator/packages/storage"
 	"github.com/gocraft/work"
 	"github.com/gomodule/redigo/redis"
-	"time"
 )
 
-type MongodbConfig struct {
-	Url              string
-	Database         string
-	Table            string
-	ReconnectTimeout time.Duration
-}
-
 type HttpListener struct {
-	Enqueuer     *work.Enqueuer
-	Repository   *storage.Repository
-	JobStack     fsm.JobStackLister
-	QueueJobName string
+	Enqueuer      *work.Enqueuer
+	Repository    *storage.Repository
+	JobStack      fsm.JobStackLister
+	GraphExporter fsm.GraphExporter
+	JobCanceller  fsm.JobCanceller
+	Limits        fsm.LimitLister
+	Simulator     fsm.GraphSimulator
+	QueueJobName  string
 }
 
 type Enqueuer struct {
@@ -27,10 +23,17 @@ type Enqueuer struct {
 	RedisPool      *redis.Pool
 }
 
+type Scheduler struct {
+	Enqueuer     *work.Enqueuer
+	QueueJobName string
+}
+
 type Handler struct {
 	QueueNamespace  string
 	QueueJobName    string
 	Concurrency     uint
 	ExecutorChannel chan<- string
-	RedisPool       *redis.Pool
+	// ExecutorChannels receive jobs of given priority, ExecutorChannel is used for missing ones
+	ExecutorChannels map[storage.Priority]chan<- string
+	RedisPool        *redis.Pool
 }
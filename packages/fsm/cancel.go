@@ -0,0 +1,143 @@
+package fsm
+
+import (
+	"context"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+	"github.com/pkg/errors"
+	"log"
+)
+
+var ErrNotCancellable = errors.New("job can't be cancelled")
+
+// rootJobKey holds id of the top level job in context of the job and its child jobs
+type rootJobKey struct{}
+
+// JobCanceller stops jobs on operator's request
+type JobCanceller interface {
+	CancelJob(id string) error
+}
+
+// CancelJob cancels job which isn't finished yet. Job which isn't executed at the moment is cancelled
+// and compensated right away. Context of running job is cancelled, so its step should stop and the job
+// is cancelled before the next transition. Job running in another process is cancelled at its next checkpoint.
+func (e *Executor) CancelJob(id string) error {
+	job, err := e.storage.FindById(id)
+
+	if err != nil {
+		return err
+	}
+
+	switch job.Status {
+	case storage.Initial, storage.Queued, storage.Waiting, storage.Paused:
+		ok, err := e.storage.CancelJob(id, job.Status, errors.Errorf("job was cancelled in %s status", job.Status))
+
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return errors.Errorf("job %s has changed its status concurrently", id)
+		}
+
+		e.compensateCancelled(job)
+	case storage.Processing:
+		ok, err := e.storage.RequestCancel(id)
+
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return errors.Errorf("job %s has changed its status concurrently", id)
+		}
+
+		if cancel, ok := e.running.Load(id); ok {
+			cancel.(context.CancelFunc)()
+		}
+	default:
+		return errors.Wrapf(ErrNotCancellable, "job %s is %s", id, job.Status)
+	}
+
+	return nil
+}
+
+// compensateCancelled compensates steps of the job which was cancelled between executions
+func (e *Executor) compensateCancelled(job *storage.Object) {
+	id := job.ID.(string)
+
+	if len(job.CompletedSteps) == 0 {
+		return
+	}
+
+	graph, ok := e.executionStore.loadGraph(job.CommandGraph, job.GraphVersion)
+
+	if !ok {
+		log.Printf("Couldn't compensate job %s, graph %s of version %q wasn't loaded", id, job.CommandGraph, job.GraphVersion)
+		return
+	}
+
+	execCont := ExecutionContext{
+		Context:               context.Background(),
+		Params:                job.Params,
+		ExecutionDependencies: e.executionDependencies,
+		JobId:                 id,
+		shared:                newJobState(job),
+	}
+
+	e.compensateJob(graph, &execCont)
+}
+
+// cancelJob stores cancellation of running job and compensates its completed steps
+func (e *Executor) cancelJob(graph storeEntry, execCont *ExecutionContext, cause error) {
+	if _, err := e.storage.CancelJob(execCont.JobId, storage.Processing, cause); err != nil {
+		log.Printf("Couldn't cancel job %s: %v", execCont.JobId, err)
+	}
+
+	e.compensateJob(graph, execCont)
+}
+
+// checkpoint stops job before the step if it was cancelled or paused from another process. Cancellation
+// of the top level job cancels the whole tree of its child jobs and branches, while branches and child jobs
+// are finished before their job is paused.
+func (e *Executor) checkpoint(ctx context.Context, node NodeName, execCont *ExecutionContext) error {
+	// simulated jobs can't be read back
+	if e.simulated {
+		return nil
+	}
+
+	rootId, ok := ctx.Value(rootJobKey{}).(string)
+	if !ok {
+		rootId = execCont.JobId
+	}
+
+	root, err := e.storage.FindById(rootId)
+
+	if err != nil {
+		log.Printf("Couldn't check whether job %s is cancelled or paused: %v", rootId, err)
+		return nil
+	}
+
+	if root.CancelRequested {
+		if cancel, ok := e.running.Load(rootId); ok {
+			cancel.(context.CancelFunc)()
+		}
+
+		return errors.Wrapf(context.Canceled, "job stopped before step %s", node)
+	}
+
+	if !root.PauseRequested || execCont.Branch != "" || execCont.child {
+		return nil
+	}
+
+	paused, err := e.storage.PauseAtCheckpoint(execCont.JobId, string(node))
+
+	if err != nil {
+		log.Printf("Couldn't pause job %s: %v", execCont.JobId, err)
+	}
+
+	if paused {
+		return errSuspended
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package fsm_test
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/fsmtest"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+func TestCancelRunningJob(t *testing.T) {
+	h := fsmtest.New(t)
+	var removed int32
+
+	sm := fsm.NewStepMap()
+	sm.AddStepWithOptions("Download", []fsm.NodeName{"Parse"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "Parse", nil
+	}, fsm.StepOptions{Compensation: func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		atomic.AddInt32(&removed, 1)
+		return "", nil
+	}})
+	sm.AddStep("Parse", []fsm.NodeName{"Store"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		if err := h.Executor.CancelJob(ec.JobId); err != nil {
+			t.Error(err)
+		}
+
+		// step cooperates by returning once its context is cancelled
+		<-ec.Context.Done()
+		return "Store", nil
+	})
+	sm.AddStep("Store", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		t.Error("cancelled import was stored")
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Import", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Import", nil).AssertStatus(storage.Cancelled).AssertPath("Download", "Parse")
+
+	if obj := job.Object(); obj.Error == "" || obj.CompensationStatus != storage.Compensated {
+		t.Fatalf("job has error %q and compensation status %s", obj.Error, obj.CompensationStatus)
+	}
+
+	if removed := atomic.LoadInt32(&removed); removed != 1 {
+		t.Fatalf("download was compensated %d times", removed)
+	}
+
+	if err := h.Executor.CancelJob(job.ID); !errors.Is(err, fsm.ErrNotCancellable) {
+		t.Fatalf("finished job was cancelled with %v", err)
+	}
+}
+
+func TestCancelJobRunByAnotherExecutor(t *testing.T) {
+	h := fsmtest.New(t)
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Approve", []fsm.NodeName{"Transfer"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		// another executor only marks the job, since it doesn't run it
+		if ok, err := h.Repository.RequestCancel(ec.JobId); !ok || err != nil {
+			t.Errorf("cancel wasn't requested: %v", err)
+		}
+
+		return "Transfer", nil
+	})
+	sm.AddStep("Transfer", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		t.Error("cancelled payout was transferred")
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Payout", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Run("Payout", nil).AssertStatus(storage.Cancelled).AssertPath("Approve")
+}
+
+func TestCancelWaitingJob(t *testing.T) {
+	h := fsmtest.New(t)
+	var released int32
+
+	sm := fsm.NewStepMap()
+	sm.AddStepWithOptions("Hold", []fsm.NodeName{"Release"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return ec.ContinueAfter("Release", time.Hour*24), nil
+	}, fsm.StepOptions{Compensation: func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		atomic.AddInt32(&released, 1)
+		return "", nil
+	}})
+	sm.AddStep("Release", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		t.Error("cancelled hold has reached its time")
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Hold", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Hold", nil).AssertStatus(storage.Waiting)
+
+	if err := h.Executor.CancelJob(job.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// job isn't executed, so it's compensated right away and its timer is ignored
+	job.AssertStatus(storage.Cancelled).Advance(time.Hour * 24).AssertStatus(storage.Cancelled).AssertPath("Hold")
+
+	if released := atomic.LoadInt32(&released); released != 1 {
+		t.Fatalf("hold was compensated %d times", released)
+	}
+}
+
+func TestCancelInitialJob(t *testing.T) {
+	h := fsmtest.New(t)
+
+	job, err := h.Repository.CreateJob(storage.ObjectDTO{CommandGraph: "Unregistered", Status: storage.Initial})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Executor.CancelJob(job.ID.(string)); err != nil {
+		t.Fatal(err)
+	}
+
+	if obj, _ := h.Repository.FindById(job.ID.(string)); obj.Status != storage.Cancelled || obj.Error == "" {
+		t.Fatalf("job has %s status and error %q", obj.Status, obj.Error)
+	}
+}
+
+func TestCancelParentFromChildJob(t *testing.T) {
+	h := fsmtest.New(t)
+
+	render := fsm.NewStepMap()
+	render.AddStep("Render", []fsm.NodeName{"Upload"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		child, err := h.Repository.FindById(ec.JobId)
+
+		if err != nil {
+			return "", err
+		}
+
+		// cancellation of the top level job stops its child jobs too
+		if err := h.Executor.CancelJob(child.ParentId); err != nil {
+			t.Error(err)
+		}
+
+		<-ec.Context.Done()
+		return "Upload", nil
+	})
+	render.AddStep("Upload", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		t.Error("child job of cancelled job went on")
+		return "", nil
+	})
+
+	report := fsm.NewStepMap()
+	report.AddSubGraph("Render", fsm.SubGraph{Graph: "Render", OnComplete: "Send"})
+	report.AddStep("Send", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		t.Error("cancelled report was sent")
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Render", render); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Executor.AddControlGraph("Report", report); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Report", nil).AssertStatus(storage.Cancelled).AssertPath("Render")
+
+	if children := job.Object().Children; len(children) != 1 {
+		t.Fatalf("job has children %v", children)
+	}
+}
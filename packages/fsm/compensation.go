@@ -0,0 +1,79 @@
+package fsm
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"log"
+)
+
+// completeStep remembers step which has to be compensated if job fails later on
+func (e *Executor) completeStep(node NodeName, execCont *ExecutionContext) {
+	execCont.shared.mux.Lock()
+	execCont.shared.completed = append(execCont.shared.completed, node)
+	execCont.shared.mux.Unlock()
+
+	// inability to record step shouldn't cripple graph execution
+	if err := e.storage.CompleteStep(execCont.JobId, string(node)); err != nil {
+		log.Printf("Couldn't record completed step %s of job %s: %v", node, execCont.JobId, err)
+	}
+}
+
+// compensate executes compensations of completed steps in reverse order, every compensation is
+// attempted even if previous one failed. Returns false if there was nothing to compensate.
+func (e *Executor) compensate(graph storeEntry, execCont *ExecutionContext) (bool, error) {
+	execCont.shared.mux.RLock()
+	completed := make([]NodeName, len(execCont.shared.completed))
+	copy(completed, execCont.shared.completed)
+	execCont.shared.mux.RUnlock()
+
+	if len(completed) == 0 {
+		return false, nil
+	}
+
+	var firstErr error
+
+	for i := len(completed) - 1; i >= 0; i-- {
+		name := completed[i]
+		node, ok := graph.stepMap[name]
+
+		if !ok || node.options.Compensation == nil {
+			continue
+		}
+
+		// job context may be already done, but compensation has to be executed anyway
+		handler := e.stepHandler(graph, node.options.Compensation)
+		_, err := runStep(context.Background(), name, node.options.Timeout, handler, execCont)
+
+		if err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "compensation of step %s failed", name)
+		}
+
+		if recErr := e.storage.RecordCompensation(execCont.JobId, string(name), err); recErr != nil {
+			log.Printf("Couldn't record compensation of step %s of job %s: %v", name, execCont.JobId, recErr)
+		}
+	}
+
+	return true, firstErr
+}
+
+// failJob stores job failure and compensates its completed steps
+func (e *Executor) failJob(graph storeEntry, execCont *ExecutionContext, err error) {
+	if isTimeout(err) {
+		_ = e.storage.TimeoutJob(execCont.JobId, err)
+	} else {
+		_ = e.storage.FailJob(execCont.JobId, err)
+	}
+
+	e.compensateJob(graph, execCont)
+}
+
+// compensateJob compensates completed steps of finished job and stores the outcome
+func (e *Executor) compensateJob(graph storeEntry, execCont *ExecutionContext) {
+	compensated, err := e.compensate(graph, execCont)
+
+	if !compensated {
+		return
+	}
+
+	_ = e.storage.FinishCompensation(execCont.JobId, err)
+}
@@ -0,0 +1,124 @@
+package fsm_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/fsmtest"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+func TestCompensationInReverseOrder(t *testing.T) {
+	h := fsmtest.New(t)
+	compensated := make([]string, 0)
+
+	cancelBooking := func(booking string) fsm.StepFunction {
+		return func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+			compensated = append(compensated, booking)
+			return "", nil
+		}
+	}
+
+	sm := fsm.NewStepMap()
+	sm.AddStepWithOptions("Flight", []fsm.NodeName{"Notify"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "Notify", nil
+	}, fsm.StepOptions{Compensation: cancelBooking("Flight")})
+	sm.AddStep("Notify", []fsm.NodeName{"Hotel"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "Hotel", nil
+	})
+	sm.AddStepWithOptions("Hotel", []fsm.NodeName{"Car"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "Car", nil
+	}, fsm.StepOptions{Compensation: cancelBooking("Hotel")})
+	// failed step isn't completed, so its own compensation isn't executed
+	sm.AddStepWithOptions("Car", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", errors.New("no cars left")
+	}, fsm.StepOptions{Compensation: cancelBooking("Car")})
+
+	if err := h.Executor.AddControlGraph("Trip", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Trip", nil).AssertStatus(storage.Compensated)
+	obj := job.Object()
+
+	if obj.CompensationStatus != storage.Compensated || obj.Error != "no cars left" {
+		t.Fatalf("job has compensation status %s and error %q", obj.CompensationStatus, obj.Error)
+	}
+
+	if len(compensated) != 2 || compensated[0] != "Hotel" || compensated[1] != "Flight" {
+		t.Fatalf("steps were compensated in order %v", compensated)
+	}
+
+	if len(obj.Compensations) != 2 || obj.Compensations[0].Step != "Hotel" || obj.Compensations[1].Step != "Flight" {
+		t.Fatalf("job has recorded compensations %v", obj.Compensations)
+	}
+}
+
+func TestCompensationFailure(t *testing.T) {
+	h := fsmtest.New(t)
+	var refunded bool
+
+	sm := fsm.NewStepMap()
+	sm.AddStepWithOptions("Charge", []fsm.NodeName{"Reserve"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "Reserve", nil
+	}, fsm.StepOptions{Compensation: func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		refunded = true
+		return "", nil
+	}})
+	sm.AddStepWithOptions("Reserve", []fsm.NodeName{"Ship"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "Ship", nil
+	}, fsm.StepOptions{Compensation: func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", errors.New("warehouse is unavailable")
+	}})
+	sm.AddStep("Ship", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", errors.New("courier is unavailable")
+	})
+
+	if err := h.Executor.AddControlGraph("Order", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := h.Run("Order", nil).AssertStatus(storage.CompensationFailed).Object()
+
+	if obj.CompensationError == "" || obj.Error != "courier is unavailable" {
+		t.Fatalf("job has failed with %q and compensation error %q", obj.Error, obj.CompensationError)
+	}
+
+	// failed compensation doesn't stop compensation of earlier steps
+	if !refunded {
+		t.Fatal("charge wasn't compensated")
+	}
+
+	if len(obj.Compensations) != 2 || obj.Compensations[0].Error != "warehouse is unavailable" || obj.Compensations[1].Error != "" {
+		t.Fatalf("job has recorded compensations %v", obj.Compensations)
+	}
+}
+
+func TestCompensationKeepsTimeout(t *testing.T) {
+	h := fsmtest.New(t)
+	var released bool
+
+	sm := fsm.NewStepMap()
+	sm.AddStepWithOptions("Hold", []fsm.NodeName{"Confirm"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "Confirm", nil
+	}, fsm.StepOptions{Compensation: func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		released = true
+		return "", nil
+	}})
+	sm.AddStep("Confirm", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		<-ec.Context.Done()
+		return "", ec.Context.Err()
+	})
+
+	if err := h.Executor.AddControlGraphWithOptions("Seat", sm, fsm.GraphOptions{Timeout: time.Millisecond * 20}); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := h.Run("Seat", nil).AssertStatus(storage.TimedOut).Object()
+
+	if obj.CompensationStatus != storage.Compensated || !released {
+		t.Fatalf("job has compensation status %s", obj.CompensationStatus)
+	}
+}
@@ -0,0 +1,59 @@
+package fsm
+
+import (
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+	"github.com/pkg/errors"
+)
+
+// resolveEntryPoints picks the root of the graph and the set of nodes jobs may start from
+func resolveEntryPoints(sm stepMap, roots nodeSet, options GraphOptions) (NodeName, nodeSet, error) {
+	root := options.Root
+
+	if root == "" && len(options.EntryPoints) > 0 {
+		root = options.EntryPoints[0]
+	}
+
+	if root == "" {
+		if len(roots) != 1 {
+			return "", nil, errors.Errorf("control graph has ambiguous roots %s, entry point has to be given", roots)
+		}
+
+		for node := range roots {
+			root = node
+		}
+	}
+
+	entryPoints := NewNodeSet(options.EntryPoints...)
+	entryPoints.Set(root)
+
+	for node := range entryPoints {
+		if _, ok := sm[node]; !ok {
+			return "", nil, errors.Errorf("entry point %s is absent in control graph", node)
+		}
+	}
+
+	return root, entryPoints, nil
+}
+
+// startNode returns node job should be executed from, jobs that were already
+// started are resumed from their last checkpoint
+func startNode(job *storage.Object, graph storeEntry) (NodeName, error) {
+	switch {
+	case job.Status == storage.Waiting && job.AwaitedSignal != "":
+		return NodeName(job.SignalTimeoutStep), nil
+	case job.Status == storage.Waiting || job.Status == storage.Queued:
+		if job.CurrentStep != "" {
+			return NodeName(job.CurrentStep), nil
+		}
+	}
+
+	if job.EntryPoint == "" {
+		return graph.root, nil
+	}
+
+	if !graph.entryPoints.Has(NodeName(job.EntryPoint)) {
+		return "", errors.Errorf("%s is not an entry point of graph %s, use one of %s", job.EntryPoint, graph.name, graph.entryPoints)
+	}
+
+	return NodeName(job.EntryPoint), nil
+}
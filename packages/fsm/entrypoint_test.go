@@ -0,0 +1,111 @@
+package fsm_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/fsmtest"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+func TestEntryPoints(t *testing.T) {
+	step := func(next fsm.NodeName) fsm.StepFunction {
+		return func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+			return next, nil
+		}
+	}
+
+	// subscription is either started from signup or renewed, both end up activated
+	sm := fsm.NewStepMap()
+	sm.AddStep("Signup", []fsm.NodeName{"Activate"}, step("Activate"))
+	sm.AddStep("Renew", []fsm.NodeName{"Activate"}, step("Activate"))
+	sm.AddStep("Activate", nil, step(""))
+
+	cases := []struct {
+		name    string
+		options fsm.GraphOptions
+		job     fsm.NodeName
+		path    []fsm.NodeName
+		err     string
+	}{
+		{
+			name: "ambiguous roots",
+			err:  "ambiguous roots",
+		},
+		{
+			name:    "explicit root",
+			options: fsm.GraphOptions{Root: "Renew", EntryPoints: []fsm.NodeName{"Signup"}},
+			path:    []fsm.NodeName{"Renew", "Activate"},
+		},
+		{
+			name:    "first entry point",
+			options: fsm.GraphOptions{EntryPoints: []fsm.NodeName{"Signup", "Renew"}},
+			path:    []fsm.NodeName{"Signup", "Activate"},
+		},
+		{
+			name:    "requested entry point",
+			options: fsm.GraphOptions{EntryPoints: []fsm.NodeName{"Signup", "Renew"}},
+			job:     "Renew",
+			path:    []fsm.NodeName{"Renew", "Activate"},
+		},
+		{
+			name:    "entry point absent in graph",
+			options: fsm.GraphOptions{EntryPoints: []fsm.NodeName{"Signup", "Upgrade"}},
+			err:     "entry point Upgrade is absent",
+		},
+		{
+			name:    "absent root",
+			options: fsm.GraphOptions{Root: "Upgrade"},
+			err:     "entry point Upgrade is absent",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := fsmtest.New(t)
+			err := h.Executor.AddControlGraphWithOptions("Subscription", sm, c.options)
+
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("graph was added with %v, expected %q", err, c.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h.RunJob(storage.ObjectDTO{CommandGraph: "Subscription", EntryPoint: string(c.job)}).
+				AssertStatus(storage.Completed).
+				AssertPath(c.path...)
+		})
+	}
+}
+
+func TestUndeclaredEntryPoint(t *testing.T) {
+	h := fsmtest.New(t)
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Signup", []fsm.NodeName{"Activate"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "Activate", nil
+	})
+	sm.AddStep("Activate", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Subscription", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	// node exists in the graph, but jobs may not start from it
+	job := h.RunJob(storage.ObjectDTO{CommandGraph: "Subscription", EntryPoint: "Activate"}).
+		AssertStatus(storage.Failed).
+		AssertPath()
+
+	if job.Err == nil || !strings.Contains(job.Err.Error(), "Activate is not an entry point") {
+		t.Fatalf("job has failed with %v", job.Err)
+	}
+}
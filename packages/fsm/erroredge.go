@@ -0,0 +1,53 @@
+package fsm
+
+import "github.com/pkg/errors"
+
+// ErrorEdge routes step error to handler node, error is available there as ExecutionContext.Error
+type ErrorEdge struct {
+	// Match decides whether error is routed to the node, nil matches every error
+	Match func(err error) bool
+	Node  NodeName
+}
+
+// OnError routes errors which match target in terms of errors.Is
+func OnError(target error, node NodeName) ErrorEdge {
+	return ErrorEdge{
+		Match: func(err error) bool {
+			return errors.Is(err, target)
+		},
+		Node: node,
+	}
+}
+
+// OnAnyError routes every error, it should be the last edge
+func OnAnyError(node NodeName) ErrorEdge {
+	return ErrorEdge{
+		Node: node,
+	}
+}
+
+func (nm nodeMap) errorRoute(err error) (NodeName, bool) {
+	for _, edge := range nm.options.ErrorEdges {
+		if edge.Match == nil || edge.Match(err) {
+			return edge.Node, true
+		}
+	}
+
+	return "", false
+}
+
+// edges returns both children and error handler nodes
+func (nm nodeMap) edges() nodeSet {
+	if len(nm.options.ErrorEdges) == 0 {
+		return nm.children
+	}
+
+	edges := NewNodeSet()
+	edges.AppendNodeSet(nm.children)
+
+	for _, edge := range nm.options.ErrorEdges {
+		edges.Set(edge.Node)
+	}
+
+	return edges
+}
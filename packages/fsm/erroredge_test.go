@@ -0,0 +1,72 @@
+package fsm_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/fsmtest"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+var errDeclined = errors.New("card declined")
+
+func TestErrorEdges(t *testing.T) {
+	h := fsmtest.New(t)
+
+	sm := fsm.NewStepMap()
+	sm.AddStepWithOptions("Charge", []fsm.NodeName{"Ship"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		reason, _ := ec.GetParam("reason")
+
+		switch reason {
+		case "declined":
+			return "", errDeclined
+		case "outage":
+			return "", errors.New("bank is unavailable")
+		}
+
+		return "Ship", nil
+	}, fsm.StepOptions{
+		ErrorEdges: []fsm.ErrorEdge{
+			fsm.OnError(errDeclined, "Decline"),
+			fsm.OnAnyError("Alert"),
+		},
+	})
+	sm.AddStep("Ship", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+	sm.AddStep("Decline", []fsm.NodeName{"Notify"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		ec.SetOutput(ec.Error.Error())
+		return "Notify", nil
+	})
+	sm.AddStep("Alert", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", ec.Error
+	})
+	sm.AddStep("Notify", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		// error is available only to the node it was routed to
+		if ec.Error != nil {
+			return "", errors.New("error has leaked past its handler")
+		}
+
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Order", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Run("Order", nil).AssertStatus(storage.Completed).AssertPath("Charge", "Ship")
+
+	h.Run("Order", map[string]interface{}{"reason": "declined"}).
+		AssertStatus(storage.Completed).
+		AssertPath("Charge", "Decline", "Notify").
+		AssertOutput(errDeclined.Error())
+
+	job := h.Run("Order", map[string]interface{}{"reason": "outage"}).
+		AssertStatus(storage.Failed).
+		AssertPath("Charge", "Alert")
+
+	if job.Err == nil || job.Err.Error() != "bank is unavailable" {
+		t.Fatalf("job has failed with %v", job.Err)
+	}
+}
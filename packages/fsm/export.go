@@ -0,0 +1,330 @@
+package fsm
+
+import (
+	"fmt"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+)
+
+// ExportFormat is the text format control graph is rendered to
+type ExportFormat string
+
+var (
+	DotFormat     ExportFormat = "dot"
+	MermaidFormat ExportFormat = "mermaid"
+)
+
+var (
+	ErrUnknownGraph  = errors.New("unknown graph")
+	ErrUnknownFormat = errors.New("unknown export format")
+)
+
+// GraphExporter renders registered graphs, optionally with the path particular job took
+type GraphExporter interface {
+	ExportGraph(name string, version string, format ExportFormat) (string, error)
+	ExportJobGraph(jobId string, format ExportFormat) (string, error)
+}
+
+type edgeKind string
+
+var (
+	childEdge edgeKind = "child"
+	errorEdge edgeKind = "error"
+	joinEdge  edgeKind = "join"
+)
+
+type exportEdge struct {
+	from NodeName
+	to   NodeName
+	kind edgeKind
+}
+
+type edgeKey struct {
+	from NodeName
+	to   NodeName
+}
+
+// graphView holds everything needed for rendering in deterministic order
+type graphView struct {
+	title   string
+	root    NodeName
+	stepMap stepMap
+	nodes   []NodeName
+	edges   []exportEdge
+	visited nodeSet
+	taken   map[edgeKey]bool
+}
+
+func newGraphView(graph storeEntry) *graphView {
+	all := NewNodeSet()
+	edges := make([]exportEdge, 0)
+
+	for name, node := range graph.stepMap {
+		all.Set(name)
+
+		for child := range node.children {
+			all.Set(child)
+			edges = append(edges, exportEdge{from: name, to: child, kind: childEdge})
+		}
+
+		for _, edge := range node.options.ErrorEdges {
+			all.Set(edge.Node)
+			edges = append(edges, exportEdge{from: name, to: edge.Node, kind: errorEdge})
+		}
+
+		if node.fanOut != nil {
+			all.Set(node.fanOut.join)
+			edges = append(edges, exportEdge{from: name, to: node.fanOut.join, kind: joinEdge})
+		}
+	}
+
+	nodes := make([]NodeName, 0, len(all))
+	for node := range all {
+		nodes = append(nodes, node)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i] < nodes[j]
+	})
+
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].from != edges[j].from {
+			return edges[i].from < edges[j].from
+		}
+		if edges[i].to != edges[j].to {
+			return edges[i].to < edges[j].to
+		}
+		return edges[i].kind < edges[j].kind
+	})
+
+	return &graphView{
+		title:   fmt.Sprintf("%s@%s", graph.name, graph.version),
+		root:    graph.root,
+		stepMap: graph.stepMap,
+		nodes:   nodes,
+		edges:   edges,
+		visited: NewNodeSet(),
+		taken:   make(map[edgeKey]bool),
+	}
+}
+
+// markPath highlights nodes and edges job went through according to its checkins,
+// which are recorded separately for main path and for each fan out branch
+func (gv *graphView) markPath(checkins []storage.CheckinObj) {
+	sequences := make(map[string][]NodeName)
+	order := make([]string, 0)
+
+	for _, checkin := range checkins {
+		if _, ok := sequences[checkin.Branch]; !ok {
+			order = append(order, checkin.Branch)
+		}
+
+		sequences[checkin.Branch] = append(sequences[checkin.Branch], NodeName(checkin.Step))
+		gv.visited.Set(NodeName(checkin.Step))
+	}
+
+	for _, branch := range order {
+		sequence := sequences[branch]
+
+		for i := 1; i < len(sequence); i++ {
+			gv.taken[edgeKey{from: sequence[i-1], to: sequence[i]}] = true
+		}
+
+		if branch == "" {
+			continue
+		}
+
+		// branch is entered from fan out node and leaves into its join node
+		for name, node := range gv.stepMap {
+			if node.fanOut == nil || !node.children.Has(NodeName(branch)) || !gv.visited.Has(name) {
+				continue
+			}
+
+			gv.taken[edgeKey{from: name, to: NodeName(branch)}] = true
+
+			last := sequence[len(sequence)-1]
+			if gv.visited.Has(node.fanOut.join) && gv.stepMap[last].children.Has(node.fanOut.join) {
+				gv.taken[edgeKey{from: last, to: node.fanOut.join}] = true
+			}
+		}
+	}
+}
+
+func (gv *graphView) isLeaf(name NodeName) bool {
+	node, ok := gv.stepMap[name]
+
+	return !ok || len(node.edges()) == 0
+}
+
+func (gv *graphView) isTaken(edge exportEdge) bool {
+	return edge.kind != joinEdge && gv.taken[edgeKey{from: edge.from, to: edge.to}]
+}
+
+func (gv *graphView) dot() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "digraph %q {\n", gv.title)
+
+	for _, name := range gv.nodes {
+		attrs := []string{"shape=box"}
+		node := gv.stepMap[name]
+
+		switch {
+		case node.fanOut != nil:
+			attrs[0] = "shape=diamond"
+		case node.subGraph != nil:
+			attrs[0] = "shape=component"
+		}
+
+		styles := make([]string, 0)
+		if name == gv.root {
+			attrs = append(attrs, "peripheries=2")
+			styles = append(styles, "bold")
+		}
+		if gv.isLeaf(name) {
+			styles = append(styles, "rounded")
+		}
+		if len(styles) > 0 {
+			attrs = append(attrs, fmt.Sprintf("style=%q", strings.Join(styles, ",")))
+		}
+		if gv.visited.Has(name) {
+			attrs = append(attrs, "color=blue", "penwidth=2")
+		}
+
+		fmt.Fprintf(&sb, "  %q [%s];\n", string(name), strings.Join(attrs, ", "))
+	}
+
+	for _, edge := range gv.edges {
+		attrs := make([]string, 0)
+
+		switch edge.kind {
+		case errorEdge:
+			attrs = append(attrs, "style=dashed", `label="error"`)
+			if !gv.isTaken(edge) {
+				attrs = append(attrs, "color=red")
+			}
+		case joinEdge:
+			attrs = append(attrs, "style=dotted", `label="join"`)
+		}
+
+		if gv.isTaken(edge) {
+			attrs = append(attrs, "color=blue", "penwidth=2")
+		}
+
+		if len(attrs) > 0 {
+			fmt.Fprintf(&sb, "  %q -> %q [%s];\n", string(edge.from), string(edge.to), strings.Join(attrs, ", "))
+		} else {
+			fmt.Fprintf(&sb, "  %q -> %q;\n", string(edge.from), string(edge.to))
+		}
+	}
+
+	sb.WriteString("}\n")
+
+	return sb.String()
+}
+
+func (gv *graphView) mermaid() string {
+	var sb strings.Builder
+	ids := make(map[NodeName]string, len(gv.nodes))
+
+	fmt.Fprintf(&sb, "---\ntitle: %s\n---\nflowchart TD\n", gv.title)
+
+	for i, name := range gv.nodes {
+		id := fmt.Sprintf("n%d", i)
+		ids[name] = id
+		label := strings.ReplaceAll(string(name), `"`, "#quot;")
+		node := gv.stepMap[name]
+
+		switch {
+		case node.fanOut != nil:
+			fmt.Fprintf(&sb, "  %s{\"%s\"}\n", id, label)
+		case node.subGraph != nil:
+			fmt.Fprintf(&sb, "  %s[[\"%s\"]]\n", id, label)
+		default:
+			fmt.Fprintf(&sb, "  %s[\"%s\"]\n", id, label)
+		}
+	}
+
+	taken := make([]string, 0)
+
+	for i, edge := range gv.edges {
+		switch edge.kind {
+		case errorEdge:
+			fmt.Fprintf(&sb, "  %s -. error .-> %s\n", ids[edge.from], ids[edge.to])
+		case joinEdge:
+			fmt.Fprintf(&sb, "  %s -. join .-> %s\n", ids[edge.from], ids[edge.to])
+		default:
+			fmt.Fprintf(&sb, "  %s --> %s\n", ids[edge.from], ids[edge.to])
+		}
+
+		if gv.isTaken(edge) {
+			taken = append(taken, fmt.Sprintf("%d", i))
+		}
+	}
+
+	sb.WriteString("  classDef root stroke-width:4px\n")
+	sb.WriteString("  classDef leaf fill:#eeeeee\n")
+	sb.WriteString("  classDef visited stroke:#1f6feb,stroke-width:3px\n")
+
+	for _, name := range gv.nodes {
+		if name == gv.root {
+			fmt.Fprintf(&sb, "  class %s root\n", ids[name])
+		}
+		if gv.isLeaf(name) {
+			fmt.Fprintf(&sb, "  class %s leaf\n", ids[name])
+		}
+		if gv.visited.Has(name) {
+			fmt.Fprintf(&sb, "  class %s visited\n", ids[name])
+		}
+	}
+
+	if len(taken) > 0 {
+		fmt.Fprintf(&sb, "  linkStyle %s stroke:#1f6feb,stroke-width:3px\n", strings.Join(taken, ","))
+	}
+
+	return sb.String()
+}
+
+func (gv *graphView) render(format ExportFormat) (string, error) {
+	switch format {
+	case DotFormat:
+		return gv.dot(), nil
+	case MermaidFormat:
+		return gv.mermaid(), nil
+	default:
+		return "", errors.Wrapf(ErrUnknownFormat, "format %q", format)
+	}
+}
+
+// ExportGraph renders registered graph, empty version means the latest one
+func (e *Executor) ExportGraph(name string, version string, format ExportFormat) (string, error) {
+	graph, ok := e.executionStore.loadGraph(name, version)
+
+	if !ok {
+		return "", errors.Wrapf(ErrUnknownGraph, "graph %s of version %q", name, version)
+	}
+
+	return newGraphView(graph).render(format)
+}
+
+// ExportJobGraph renders graph of the job with highlighted path it took
+func (e *Executor) ExportJobGraph(jobId string, format ExportFormat) (string, error) {
+	job, err := e.storage.FindById(jobId)
+
+	if err != nil {
+		return "", err
+	}
+
+	graph, ok := e.executionStore.loadGraph(job.CommandGraph, job.GraphVersion)
+
+	if !ok {
+		return "", errors.Wrapf(ErrUnknownGraph, "graph %s of version %q", job.CommandGraph, job.GraphVersion)
+	}
+
+	view := newGraphView(graph)
+	view.markPath(job.Checkins)
+
+	return view.render(format)
+}
@@ -0,0 +1,95 @@
+package fsm_test
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/fsmtest"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files of export tests")
+
+func assertGolden(t *testing.T, name string, actual string) {
+	t.Helper()
+
+	path := filepath.Join("testdata", "export", name)
+
+	if *update {
+		if err := ioutil.WriteFile(path, []byte(actual), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual != string(expected) {
+		t.Errorf("export differs from %s:\n%s", path, actual)
+	}
+}
+
+func TestExport(t *testing.T) {
+	h := fsmtest.New(t)
+
+	step := func(next fsm.NodeName) fsm.StepFunction {
+		return func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+			return next, nil
+		}
+	}
+
+	sm := fsm.NewStepMap()
+	sm.AddStepWithOptions("Receive", []fsm.NodeName{"Split"}, step("Split"), fsm.StepOptions{
+		ErrorEdges: []fsm.ErrorEdge{fsm.OnAnyError("Reject")},
+	})
+	sm.AddFanOut("Split", []fsm.NodeName{"Pack", "Label"}, "Ship", fsm.JoinAll)
+	sm.AddStep("Pack", []fsm.NodeName{"Weigh"}, step("Weigh"))
+	sm.AddStep("Weigh", []fsm.NodeName{"Ship"}, step("Ship"))
+	sm.AddStep("Label", []fsm.NodeName{"Ship"}, step("Ship"))
+	sm.AddStep("Ship", nil, step(""))
+	sm.AddStep("Reject", nil, step(""))
+
+	if err := h.Executor.AddControlGraphWithOptions("Order", sm, fsm.GraphOptions{Version: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Order", nil).
+		AssertStatus(storage.Completed).
+		AssertPath("Receive", "Split", "Ship").
+		AssertBranchPath("Pack", "Pack", "Weigh").
+		AssertBranchPath("Label", "Label")
+
+	for format, ext := range map[fsm.ExportFormat]string{fsm.DotFormat: "dot", fsm.MermaidFormat: "mmd"} {
+		graph, err := h.Executor.ExportGraph("Order", "", format)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertGolden(t, "order."+ext, graph)
+
+		// job path includes fan out entry into branches and join edges out of them
+		jobGraph, err := h.Executor.ExportJobGraph(job.ID, format)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertGolden(t, "order_job."+ext, jobGraph)
+	}
+
+	if _, err := h.Executor.ExportGraph("Order", "v2", fsm.DotFormat); !errors.Is(err, fsm.ErrUnknownGraph) {
+		t.Fatalf("unknown version was exported with %v", err)
+	}
+
+	if _, err := h.Executor.ExportGraph("Order", "", "svg"); !errors.Is(err, fsm.ErrUnknownFormat) {
+		t.Fatalf("unknown format was exported with %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package fsm
+
+import (
+	"context"
+	"github.com/pkg/errors"
+)
+
+// JoinMode defines how many fan out branches have to finish before execution proceeds to join node
+type JoinMode string
+
+var (
+	JoinAll JoinMode = "all"
+	JoinAny JoinMode = "any"
+)
+
+type fanOut struct {
+	join NodeName
+	mode JoinMode
+}
+
+type branchResult struct {
+	branch NodeName
+	err    error
+}
+
+// AddFanOut adds node which executes all of its branches concurrently.
+// Each branch is executed until it reaches join node, after that execution proceeds from join node.
+func (sm stepMap) AddFanOut(node NodeName, branches []NodeName, join NodeName, mode JoinMode) {
+	sm[node] = nodeMap{
+		children: NewNodeSet(branches...),
+		fanOut: &fanOut{
+			join: join,
+			mode: mode,
+		},
+	}
+}
+
+// forBranch copies execution context for fan out branch, params and dependencies stay shared
+func (ec *ExecutionContext) forBranch(ctx context.Context, branch NodeName) *ExecutionContext {
+	return &ExecutionContext{
+		Context:               ctx,
+		Params:                ec.Params,
+		ExecutionDependencies: ec.ExecutionDependencies,
+		step:                  branch,
+		prevStep:              ec.step,
+		JobId:                 ec.JobId,
+		Branch:                branch,
+		shared:                ec.shared,
+		priority:              ec.priority,
+		clock:                 ec.clock,
+	}
+}
+
+func (e *Executor) executeBranch(ctx context.Context, branch NodeName, join NodeName, graph storeEntry, execCont *ExecutionContext) error {
+	jobId := execCont.JobId
+	// inability to record branch state shouldn't cripple graph execution
+	_ = e.storage.StartBranch(jobId, string(branch))
+
+	err := e.executeGraph(ctx, branch, join, graph, execCont)
+
+	if err != nil {
+		_ = e.storage.FailBranch(jobId, string(branch), err)
+	} else {
+		_ = e.storage.CompleteBranch(jobId, string(branch))
+	}
+
+	return err
+}
+
+func (e *Executor) executeFanOut(ctx context.Context, node NodeName, fanOutNode nodeMap, graph storeEntry, execCont *ExecutionContext) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	join := fanOutNode.fanOut.join
+	results := make(chan branchResult, len(fanOutNode.children))
+
+	for branch := range fanOutNode.children {
+		go func(branch NodeName, branchCont *ExecutionContext) {
+			err := e.executeBranch(ctx, branch, join, graph, branchCont)
+			results <- branchResult{branch: branch, err: err}
+		}(branch, execCont.forBranch(ctx, branch))
+	}
+
+	var (
+		firstErr error
+		decided  bool
+	)
+
+	// every branch is drained, so none of them keeps changing the job after fan out is over
+	for range fanOutNode.children {
+		res := <-results
+
+		if decided {
+			continue
+		}
+
+		if res.err == nil {
+			if fanOutNode.fanOut.mode == JoinAny {
+				firstErr = nil
+				decided = true
+				cancel()
+			}
+
+			continue
+		}
+
+		if firstErr == nil {
+			firstErr = errors.Wrapf(res.err, "branch %s of %s failed", res.branch, node)
+		}
+
+		// there's no point in proceeding with the rest if every branch has to succeed
+		if fanOutNode.fanOut.mode != JoinAny {
+			decided = true
+			cancel()
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,122 @@
+package fsm_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/fsmtest"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+// blockingStep reports that it has started and returns its node only after its context is done
+func blockingStep(next fsm.NodeName, started chan<- struct{}, stopped chan<- struct{}) fsm.StepFunction {
+	return func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		close(started)
+		<-ec.Context.Done()
+		close(stopped)
+		return next, nil
+	}
+}
+
+// awaitStopped waits for the step to see its context done. Branch doesn't wait for abandoned
+// handler to return, so the step may still be finishing when the job is over
+func awaitStopped(t *testing.T, stopped <-chan struct{}, step string) {
+	t.Helper()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("step %s wasn't stopped", step)
+	}
+}
+
+func TestFanOutJoinAll(t *testing.T) {
+	h := fsmtest.New(t)
+
+	sm := fsm.NewStepMap()
+	sm.AddFanOut("Split", []fsm.NodeName{"Left", "Right"}, "Join", fsm.JoinAll)
+	sm.AddStep("Left", []fsm.NodeName{"Join"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		ec.SetState("left", true)
+		return "Join", nil
+	})
+	sm.AddStep("Right", []fsm.NodeName{"Join"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		ec.SetState("right", true)
+		return "Join", nil
+	})
+	sm.AddStep("Join", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		_, left := ec.GetState("left")
+		_, right := ec.GetState("right")
+		ec.SetOutput(left && right)
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("FanOut", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Run("FanOut", nil).
+		AssertStatus(storage.Completed).
+		AssertPath("Split", "Join").
+		AssertBranchPath("Left", "Left").
+		AssertBranchPath("Right", "Right").
+		AssertOutput(true)
+}
+
+func TestFanOutJoinAnyStopsOtherBranches(t *testing.T) {
+	h := fsmtest.New(t)
+	started, stopped := make(chan struct{}), make(chan struct{})
+
+	sm := fsm.NewStepMap()
+	sm.AddFanOut("Split", []fsm.NodeName{"Fast", "Slow"}, "Join", fsm.JoinAny)
+	sm.AddStep("Fast", []fsm.NodeName{"Join"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		<-started
+		return "Join", nil
+	})
+	sm.AddStep("Slow", []fsm.NodeName{"Join"}, blockingStep("Join", started, stopped))
+	sm.AddStep("Join", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("FanOut", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Run("FanOut", nil).
+		AssertStatus(storage.Completed).
+		AssertPath("Split", "Join").
+		AssertBranchPath("Fast", "Fast")
+
+	awaitStopped(t, stopped, "Slow")
+}
+
+func TestFanOutJoinAllFailure(t *testing.T) {
+	h := fsmtest.New(t)
+	started, stopped := make(chan struct{}), make(chan struct{})
+	errBroken := errors.New("broken")
+
+	sm := fsm.NewStepMap()
+	sm.AddFanOut("Split", []fsm.NodeName{"Broken", "Slow"}, "Join", fsm.JoinAll)
+	sm.AddStep("Broken", []fsm.NodeName{"Join"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		<-started
+		return "", errBroken
+	})
+	sm.AddStep("Slow", []fsm.NodeName{"Join"}, blockingStep("Join", started, stopped))
+	sm.AddStep("Join", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		t.Error("join was reached after branch has failed")
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("FanOut", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("FanOut", nil).AssertStatus(storage.Failed).AssertPath("Split")
+
+	if !errors.Is(job.Err, errBroken) {
+		t.Fatalf("job has failed with %v, expected %v", job.Err, errBroken)
+	}
+
+	awaitStopped(t, stopped, "Slow")
+}
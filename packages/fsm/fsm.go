@@ -1,20 +1,57 @@
 package fsm
 
 import (
+	"context"
 	"fmt"
 	"github.com/Madamas/fsm-orchestrator/packages/storage"
 	"github.com/pkg/errors"
 	"log"
 	"sync"
+	"time"
 )
 
 type ExecutionContext struct {
+	// Context is cancelled when step or job runs out of time,
+	// long running steps should respect it
+	Context context.Context
+	// Params should be accessed with GetParam and SetParam in fan out branches
 	Params                map[string]interface{}
 	ExecutionDependencies *sync.Map
 
 	step     NodeName
 	prevStep NodeName
 	JobId    string
+	// Branch is the first node of fan out branch step is executed in, empty outside of branches
+	Branch NodeName
+	// Error is the error which routed execution into current error handler node, nil otherwise
+	Error error
+
+	// shared between all branches of the job
+	shared *jobState
+	// child jobs are executed by their parents
+	child    bool
+	priority storage.Priority
+	// set by step which asked to park the job
+	wakeAt time.Time
+	signal *SignalWait
+	clock  Clock
+}
+
+// GetParam provides concurrency safe read access to job params
+func (ec *ExecutionContext) GetParam(key string) (val interface{}, ok bool) {
+	ec.shared.mux.RLock()
+	defer ec.shared.mux.RUnlock()
+
+	val, ok = ec.Params[key]
+	return
+}
+
+// SetParam provides concurrency safe write access to job params
+func (ec *ExecutionContext) SetParam(key string, val interface{}) {
+	ec.shared.mux.Lock()
+	defer ec.shared.mux.Unlock()
+
+	ec.Params[key] = val
 }
 
 type StepFunction func(execCont *ExecutionContext) (NodeName, error)
@@ -22,34 +59,81 @@ type StepFunction func(execCont *ExecutionContext) (NodeName, error)
 type nodeMap struct {
 	children nodeSet
 	function StepFunction
+	options  StepOptions
+	fanOut   *fanOut
+	subGraph *SubGraph
+}
+
+// DefaultGraphVersion is used for graphs registered without explicit version
+const DefaultGraphVersion = "default"
+
+// GraphOptions describe how whole control graph is executed
+type GraphOptions struct {
+	// Version of the graph, empty value is replaced with DefaultGraphVersion.
+	// Last registered version is used for jobs which didn't ask for particular one.
+	Version string
+	// Root is the node jobs start from unless they ask for another entry point. Empty value means
+	// the first entry point or the only root of the graph, graph with several roots is rejected then.
+	Root NodeName
+	// EntryPoints are nodes which jobs may ask to start from besides the root
+	EntryPoints []NodeName
+	// Timeout limits execution of the whole job, zero means no limit.
+	// Deadline is fixed when the job is first claimed, time spent waiting for timers, signals,
+	// pause or recovery counts against it
+	Timeout time.Duration
+	// Interceptors wrap every step of the graph after executor's global interceptors
+	Interceptors []Interceptor
+	// StrictTransitions fails job when step returns node which isn't among its children, see End
+	StrictTransitions bool
+	// MaxConcurrency limits number of jobs of the graph executed at once, zero means no limit.
+	// Jobs over the limit wait in line without holding executor.
+	MaxConcurrency int
 }
 
 type storeEntry struct {
-	stepMap stepMap
-	root    NodeName
+	name        string
+	version     string
+	stepMap     stepMap
+	root        NodeName
+	entryPoints nodeSet
+	options     GraphOptions
 }
 
 type executionStore struct {
-	mux   sync.RWMutex
-	store map[string]storeEntry
+	mux    sync.RWMutex
+	store  map[string]map[string]storeEntry
+	latest map[string]string
 }
 
-func (es *executionStore) loadGraph(key string) (val storeEntry, ok bool) {
+// loadGraph finds graph by name and version, empty version means the latest one
+func (es *executionStore) loadGraph(name string, version string) (val storeEntry, ok bool) {
 	es.mux.RLock()
 	defer es.mux.RUnlock()
 
-	val, ok = es.store[key]
+	if version == "" {
+		version = es.latest[name]
+	}
+
+	val, ok = es.store[name][version]
 	return
 }
 
-func (es *executionStore) storeGraph(key string, entry storeEntry) {
+func (es *executionStore) storeGraph(entry storeEntry) {
 	es.mux.Lock()
 	defer es.mux.Unlock()
 
-	es.store[key] = entry
+	versions, ok := es.store[entry.name]
+	if !ok {
+		versions = make(map[string]storeEntry)
+		es.store[entry.name] = versions
+	}
+
+	versions[entry.version] = entry
+	es.latest[entry.name] = entry.version
 }
 
 type Executor struct {
+	// ExecutorChannel receives jobs of normal priority, see Channel
 	ExecutorChannel       chan string
 	JobStack              JobStack
 	executionDependencies *sync.Map
@@ -57,11 +141,22 @@ type Executor struct {
 	executionStore        executionStore
 	consumerSemaphore     sync.WaitGroup
 	concurrency           int
+	interceptors          []Interceptor
+	observers             observers
+	strictTransitions     bool
+	scheduler             Scheduler
+	clock                 Clock
+	intake                *intake
+	limits                limits
+	// simulated executor doesn't wait for timers and signals
+	simulated bool
+	// cancel functions of jobs executed at the moment
+	running sync.Map
 }
 
 func NewExecutor(storage *storage.Repository, dependencies *sync.Map, concurrency int) *Executor {
 	echan := make(chan string)
-	store := make(map[string]storeEntry)
+	store := make(map[string]map[string]storeEntry)
 	jobStack := NewJobStack(5)
 
 	return &Executor{
@@ -71,9 +166,15 @@ func NewExecutor(storage *storage.Repository, dependencies *sync.Map, concurrenc
 		storage:               storage,
 		consumerSemaphore:     sync.WaitGroup{},
 		concurrency:           concurrency,
+		clock:                 time.Now,
+		intake:                newIntake(),
+		limits: limits{
+			limits: make(map[limitKey]*limit),
+		},
 		executionStore: executionStore{
-			store: store,
-			mux:   sync.RWMutex{},
+			store:  store,
+			latest: make(map[string]string),
+			mux:    sync.RWMutex{},
 		},
 	}
 }
@@ -83,16 +184,39 @@ func (e *Executor) GetJobStack() JobStackLister {
 }
 
 func (e *Executor) AddControlGraph(name string, sm stepMap) error {
-	root, err := checkGraph(sm)
+	return e.AddControlGraphWithOptions(name, sm, GraphOptions{})
+}
+
+func (e *Executor) AddControlGraphWithOptions(name string, sm stepMap, options GraphOptions) error {
+	roots, err := checkGraph(sm)
 
 	if err != nil {
 		return err
 	}
 
-	e.executionStore.storeGraph(name, storeEntry{
-		stepMap: sm,
-		root:    root,
+	root, entryPoints, err := resolveEntryPoints(sm, roots, options)
+
+	if err != nil {
+		return err
+	}
+
+	if options.Version == "" {
+		options.Version = DefaultGraphVersion
+	}
+
+	if err := e.checkSubGraphs(name, options.Version, sm); err != nil {
+		return err
+	}
+
+	e.executionStore.storeGraph(storeEntry{
+		name:        name,
+		version:     options.Version,
+		stepMap:     sm,
+		root:        root,
+		entryPoints: entryPoints,
+		options:     options,
 	})
+	e.setLimits(name, sm, options)
 
 	return nil
 }
@@ -106,32 +230,146 @@ func (e *Executor) StartProcessing() {
 	}
 }
 
-func (e *Executor) executeGraph(node NodeName, al stepMap, execCont *ExecutionContext) error {
+// executeGraph walks control graph starting from node until it reaches either
+// until node or node which is absent in step map
+func (e *Executor) executeGraph(ctx context.Context, node NodeName, until NodeName, graph storeEntry, execCont *ExecutionContext) error {
+	if node == until {
+		return nil
+	}
+
+	// job deadline is checked between steps so we won't proceed to the next one
+	if err := ctx.Err(); err != nil {
+		return errors.Wrapf(err, "job stopped before step %s", node)
+	}
+
+	if err := e.checkpoint(ctx, node, execCont); err != nil {
+		return err
+	}
+
 	// inability to checkin shouldn't cripple graph execution
-	err := e.storage.CheckinJob(execCont.JobId, string(node))
-	executor, ok := al[node]
+	if execCont.Branch != "" {
+		_ = e.storage.CheckinBranch(execCont.JobId, string(execCont.Branch), string(node))
+	} else {
+		_ = e.storage.CheckinJob(execCont.JobId, string(node))
+	}
+
+	executor, ok := graph.stepMap[node]
 
 	if !ok {
 		return nil
 	}
 
-	nextNode, err := executor.function(execCont)
+	if executor.fanOut != nil {
+		err := e.executeFanOut(ctx, node, executor, graph, execCont)
+
+		if err != nil {
+			return err
+		}
+
+		execCont.prevStep = node
+		execCont.step = executor.fanOut.join
+
+		return e.executeGraph(ctx, executor.fanOut.join, until, graph, execCont)
+	}
+
+	if executor.subGraph != nil {
+		nextNode, err := e.executeSubGraph(ctx, node, executor.subGraph, execCont)
+
+		if err != nil {
+			return err
+		}
+
+		execCont.prevStep = node
+		execCont.step = nextNode
+
+		return e.executeGraph(ctx, nextNode, until, graph, execCont)
+	}
+
+	nodeLimit := e.limits.get(limitKey{graph: graph.name, node: node})
+
+	if nodeLimit != nil {
+		if err := nodeLimit.wait(ctx); err != nil {
+			return errors.Wrapf(err, "job stopped while waiting for step %s", node)
+		}
+	}
+
+	e.observers.StepStarted(execCont.JobId, node)
+	started := time.Now()
+
+	execCont.wakeAt = time.Time{}
+	execCont.signal = nil
+	handler := e.stepHandler(graph, executor.function)
+	nextNode, err := e.retryStep(ctx, node, executor, handler, execCont)
+
+	if nodeLimit != nil {
+		nodeLimit.release()
+	}
+
+	e.observers.StepFinished(execCont.JobId, node, nextNode, err, time.Since(started))
+	e.saveState(execCont)
+	execCont.Error = nil
 
 	if err != nil {
-		return err
+		handlerNode, ok := executor.errorRoute(err)
+
+		// dead job context can't be handled by the graph
+		if !ok || ctx.Err() != nil {
+			return err
+		}
+
+		execCont.prevStep = node
+		execCont.step = handlerNode
+		execCont.Error = err
+
+		return e.executeGraph(ctx, handlerNode, until, graph, execCont)
+	}
+
+	if executor.options.Compensation != nil {
+		e.completeStep(node, execCont)
+	}
+
+	if e.strictTransitions || graph.options.StrictTransitions {
+		if err := checkTransition(node, executor, nextNode); err != nil {
+			return err
+		}
+
+		if execCont.signal != nil && execCont.signal.TimeoutNode != "" {
+			if err := checkTransition(node, executor, execCont.signal.TimeoutNode); err != nil {
+				return errors.Wrapf(err, "timeout node of signal %s", execCont.signal.Name)
+			}
+		}
+	}
+
+	// cancelled job mustn't be parked
+	if err := ctx.Err(); err != nil {
+		return errors.Wrapf(err, "job stopped after step %s", node)
+	}
+
+	if execCont.signal != nil && !e.simulated {
+		return e.awaitSignal(execCont.signal, execCont)
+	}
+
+	if !execCont.wakeAt.IsZero() && !e.simulated {
+		return e.wait(nextNode, execCont.wakeAt, execCont)
 	}
 
 	execCont.prevStep = node
 	execCont.step = nextNode
 
-	return e.executeGraph(nextNode, al, execCont)
+	return e.executeGraph(ctx, nextNode, until, graph, execCont)
 }
 
 func (e *Executor) stepConsumer() {
 	defer e.consumerSemaphore.Done()
 	var previousEvent string
 
-	for event := range e.ExecutorChannel {
+	for {
+		event, ok := e.takeJob()
+
+		if !ok {
+			break
+		}
+
 		// costyl for in-loop defer
 		if previousEvent != "" {
 			e.JobStack.FinishJob(previousEvent)
@@ -142,43 +380,176 @@ func (e *Executor) stepConsumer() {
 		e.JobStack.StartJob(event)
 		log.Printf("Started event %s", event)
 		previousEvent = event
+		_ = e.RunJob(event)
+	}
+}
 
-		job, err := e.storage.FindById(event)
+// RunJob executes job synchronously in calling goroutine, bypassing executor channels.
+// Job which was suspended or skipped isn't an error, its status tells what happened.
+func (e *Executor) RunJob(id string) error {
+	e.observers.JobReceived(id)
 
-		if err != nil || job == nil {
-			fmt.Println("Couldn't find job", err)
-			continue
+	job, err := e.storage.FindById(id)
+
+	if err == nil && job == nil {
+		err = errors.New("job doesn't exist")
+	}
+
+	if err != nil {
+		fmt.Println("Couldn't find job", err)
+		err = errors.Wrap(err, "couldn't find job")
+		e.observers.JobFailed(id, err)
+		return err
+	}
+
+	graph, ok := e.executionStore.loadGraph(job.CommandGraph, job.GraphVersion)
+
+	if !ok {
+		e.observers.UnknownGraph(id, job.CommandGraph)
+		err = errors.Errorf("execution graph %s of version %q wasn't loaded", job.CommandGraph, job.GraphVersion)
+		if failErr := e.storage.FailJob(job.ID.(string), err); failErr != nil {
+			fmt.Println("Couldn't fail job", failErr.Error())
 		}
+		return err
+	}
 
-		graph, ok := e.executionStore.loadGraph(job.CommandGraph)
+	_, err = e.runJob(context.Background(), job, graph)
 
-		if !ok {
-			err = e.storage.FailJob(job.ID.(string), errors.New("execution graph wasn't loaded"))
-			if err != nil {
-				fmt.Println("Couldn't fail job", err.Error())
-			}
+	if errors.Is(err, errSuspended) || errors.Is(err, errSkipped) {
+		return nil
+	}
+
+	return err
+}
+
+// runJob executes job from its start node and stores the outcome
+func (e *Executor) runJob(parent context.Context, job *storage.Object, graph storeEntry) (*ExecutionContext, error) {
+	id := job.ID.(string)
+
+	graphLimit := e.limits.get(limitKey{graph: graph.name})
+
+	if !e.deliverable(job) {
+		log.Printf("Skipped job %s in %s status", id, job.Status)
+		if graphLimit != nil {
+			graphLimit.forfeit(id)
+		}
+		return nil, errSkipped
+	}
+
+	start, err := startNode(job, graph)
+
+	if err != nil {
+		if graphLimit != nil {
+			graphLimit.forfeit(id)
 		}
+		_ = e.storage.FailJob(id, err)
+		e.observers.JobFailed(id, err)
+		return nil, err
+	}
 
-		err = e.storage.StartJob(job.ID.(string), string(graph.root))
-		if err != nil {
-			fmt.Println("Error while starting job", err)
-			continue
+	// cancel function is registered before the job is claimed, so cancellation can't be missed
+	// deadline is set on first claim and kept across recovery and parking
+	deadline := job.Deadline
+	if deadline.IsZero() && graph.options.Timeout > 0 {
+		deadline = e.clock().Add(graph.options.Timeout)
+	}
+
+	ctx, cancel := jobContext(parent, deadline, e.clock())
+	defer cancel()
+
+	// child jobs are cancelled along with the top level job
+	if _, ok := parent.Value(rootJobKey{}).(string); !ok {
+		ctx = context.WithValue(ctx, rootJobKey{}, id)
+	}
+
+	if _, running := e.running.LoadOrStore(id, cancel); running {
+		log.Printf("Job %s is already running", id)
+		return nil, errSkipped
+	}
+	defer e.running.Delete(id)
+
+	if graphLimit != nil {
+		if ok, err := e.acquireGraph(ctx, graphLimit, job); !ok {
+			return nil, err
 		}
+		defer graphLimit.release()
+	}
 
-		eCont := ExecutionContext{
-			Params:                job.Params,
-			ExecutionDependencies: e.executionDependencies,
-			step:                  graph.root,
-			prevStep:              graph.root,
-			JobId:                 job.ID.(string),
+	claimed, err := e.storage.ClaimJob(id, job.Status, string(start))
+	if err != nil {
+		fmt.Println("Error while starting job", err)
+		err = errors.Wrap(err, "couldn't start job")
+		e.observers.JobFailed(id, err)
+		return nil, err
+	}
+
+	// concurrent delivery of the same job has already started it
+	if !claimed {
+		log.Printf("Job %s was already claimed", id)
+		return nil, errSkipped
+	}
+
+	if job.Deadline.IsZero() && !deadline.IsZero() {
+		if err := e.storage.SetDeadline(id, deadline); err != nil {
+			log.Printf("Couldn't store deadline of job %s: %v", id, err)
 		}
+	}
 
-		err = e.executeGraph(graph.root, graph.stepMap, &eCont)
+	// job stays on the same graph version until it's finished, even if newer one was registered
+	if job.GraphVersion == "" {
+		if err := e.storage.PinGraphVersion(id, graph.version); err != nil {
+			log.Printf("Couldn't pin graph version of job %s: %v", id, err)
+		}
+	}
 
-		if err != nil {
-			_ = e.storage.FailJob(job.ID.(string), err)
-		} else {
-			_ = e.storage.CompleteJob(job.ID.(string))
+	// cancellation was requested before crash
+	if job.CancelRequested {
+		cancel()
+	}
+
+	e.observers.JobStarted(id, job.CommandGraph, start)
+
+	shared := newJobState(job)
+
+	// resumed job waits for child jobs it has already created instead of creating them again
+	if job.Status == storage.Queued && len(job.Children) > 0 {
+		shared.children = e.resumableChildren(job)
+	}
+
+	eCont := ExecutionContext{
+		Context:               ctx,
+		Params:                job.Params,
+		ExecutionDependencies: e.executionDependencies,
+		step:                  start,
+		prevStep:              start,
+		JobId:                 id,
+		shared:                shared,
+		child:                 job.ParentId != "",
+		priority:              job.Priority,
+		clock:                 e.clock,
+	}
+
+	err = e.executeGraph(ctx, start, "", graph, &eCont)
+
+	if errors.Is(err, errSuspended) {
+		return &eCont, err
+	}
+
+	if err == nil {
+		_ = e.storage.CompleteJob(id)
+		e.observers.JobCompleted(id)
+	} else if ctx.Err() == context.Canceled {
+		e.cancelJob(graph, &eCont, err)
+		e.observers.JobFailed(id, err)
+	} else if errors.Is(err, errInterrupted) {
+		if interruptErr := e.storage.InterruptJob(id, err); interruptErr != nil {
+			log.Printf("Couldn't interrupt job %s: %v", id, interruptErr)
 		}
+		e.observers.JobFailed(id, err)
+	} else {
+		e.failJob(graph, &eCont, err)
+		e.observers.JobFailed(id, err)
 	}
+
+	return &eCont, err
 }
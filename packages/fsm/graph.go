@@ -42,15 +42,17 @@ func deepSearch(start NodeName, sm stepMap, nodeColors *colormap, children nodeS
 		(*nodeColors)[start] = Grey
 	}
 
-	for node, _ := range node.children {
+	for node, _ := range node.edges() {
 		color, ok := (*nodeColors)[node]
 
 		if ok {
-			if color == Black {
-				(*nodeColors)[start] = Black
+			// grey child is on the current path, so we've got back into it,
+			// black one is already checked and the rest of children still has to be
+			if color == Grey {
+				return true
 			}
 
-			return color == Grey
+			continue
 		}
 
 		hasCycle := deepSearch(node, sm, nodeColors, children, roots)
@@ -68,24 +70,6 @@ func deepSearch(start NodeName, sm stepMap, nodeColors *colormap, children nodeS
 	return false
 }
 
-func probeDepth(parent NodeName, sm stepMap) int {
-	node, ok := sm[parent]
-	if !ok {
-		return 1
-	}
-
-	max := 1
-
-	for node, _ := range node.children {
-		val := 1 + probeDepth(node, sm)
-		if val > max {
-			max = val
-		}
-	}
-
-	return max
-}
-
 // DfsSort uses recursive deep first search algorithm to find cycles
 // and topologically sort control graph
 func dfsSort(sm stepMap, childrens nodeSet) (hasCycle bool, roots nodeSet) {
@@ -103,30 +87,19 @@ func dfsSort(sm stepMap, childrens nodeSet) (hasCycle bool, roots nodeSet) {
 	return
 }
 
-// checkGraph finds if control graph and finds deepest root
-func checkGraph(sm stepMap) (NodeName, error) {
+// checkGraph checks control graph for cycles and finds its roots
+func checkGraph(sm stepMap) (nodeSet, error) {
 	childrenList := NewNodeSet()
 
 	for _, v := range sm {
-		childrenList.AppendNodeSet(v.children)
+		childrenList.AppendNodeSet(v.edges())
 	}
 
 	hasCycles, roots := dfsSort(sm, childrenList)
 
 	if hasCycles {
-		return "", errors.New("control graph can't hold cycles")
-	}
-
-	var maxRootName NodeName
-	maxRootDepth := 1
-
-	for node, _ := range roots {
-		depth := probeDepth(node, sm)
-		if depth >= maxRootDepth {
-			maxRootDepth = depth
-			maxRootName = node
-		}
+		return nil, errors.New("control graph can't hold cycles")
 	}
 
-	return maxRootName, nil
+	return roots, nil
 }
@@ -0,0 +1,139 @@
+package fsm
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func blankStep(ec *ExecutionContext) (NodeName, error) {
+	return "", nil
+}
+
+func TestCheckGraph(t *testing.T) {
+	cases := []struct {
+		name  string
+		build func(sm stepMap)
+		cycle bool
+		roots []NodeName
+	}{
+		{
+			name: "diamond",
+			build: func(sm stepMap) {
+				sm.AddStep("A", []NodeName{"B", "C"}, blankStep)
+				sm.AddStep("B", []NodeName{"D"}, blankStep)
+				sm.AddStep("C", []NodeName{"D"}, blankStep)
+				sm.AddStep("D", nil, blankStep)
+			},
+			roots: []NodeName{"A"},
+		},
+		{
+			name: "shared error handler",
+			build: func(sm stepMap) {
+				sm.AddStepWithOptions("A", []NodeName{"B"}, blankStep, StepOptions{
+					ErrorEdges: []ErrorEdge{OnAnyError("Handle")},
+				})
+				sm.AddStepWithOptions("B", nil, blankStep, StepOptions{
+					ErrorEdges: []ErrorEdge{OnAnyError("Handle")},
+				})
+				sm.AddStep("Handle", nil, blankStep)
+			},
+			roots: []NodeName{"A"},
+		},
+		{
+			name: "cycle through error edge",
+			build: func(sm stepMap) {
+				sm.AddStep("A", []NodeName{"B"}, blankStep)
+				sm.AddStepWithOptions("B", nil, blankStep, StepOptions{
+					ErrorEdges: []ErrorEdge{OnAnyError("A")},
+				})
+			},
+			cycle: true,
+		},
+		{
+			name: "cycle after visited sibling",
+			build: func(sm stepMap) {
+				sm.AddStep("A", []NodeName{"B", "C"}, blankStep)
+				sm.AddStep("B", nil, blankStep)
+				sm.AddStep("C", []NodeName{"D"}, blankStep)
+				sm.AddStep("D", []NodeName{"C"}, blankStep)
+			},
+			cycle: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sm := NewStepMap()
+			c.build(sm)
+
+			// nodes and children are visited in map order, so every run takes another path through the graph
+			for i := 0; i < 20; i++ {
+				roots, err := checkGraph(sm)
+
+				if c.cycle {
+					if err == nil {
+						t.Fatal("cycle wasn't found")
+					}
+
+					continue
+				}
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(roots) != len(c.roots) {
+					t.Fatalf("graph has roots %v, expected %v", roots, c.roots)
+				}
+
+				for _, root := range c.roots {
+					if !roots.Has(root) {
+						t.Fatalf("graph has roots %v, expected %v", roots, c.roots)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDeepSearchPassesVisitedSibling(t *testing.T) {
+	sm := NewStepMap()
+	sm.AddStep("A", []NodeName{"B", "C"}, blankStep)
+	sm.AddStep("B", nil, blankStep)
+	sm.AddStep("C", []NodeName{"C"}, blankStep)
+
+	// checked sibling is met before or after the cycle depending on map order
+	for i := 0; i < 20; i++ {
+		colors := colormap{"B": Black}
+
+		if !deepSearch("A", sm, &colors, NewNodeSet("B", "C"), NewNodeSet()) {
+			t.Fatal("cycle behind checked sibling wasn't found")
+		}
+	}
+}
+
+func TestErrorRoute(t *testing.T) {
+	errDeclined := errors.New("declined")
+
+	node := nodeMap{
+		options: StepOptions{
+			ErrorEdges: []ErrorEdge{
+				OnError(errDeclined, "Decline"),
+				OnAnyError("Retry"),
+			},
+		},
+	}
+
+	if next, ok := node.errorRoute(errors.New("timeout")); !ok || next != "Retry" {
+		t.Fatalf("error was routed to %s", next)
+	}
+
+	if next, ok := node.errorRoute(fmt.Errorf("charge: %w", errDeclined)); !ok || next != "Decline" {
+		t.Fatalf("wrapped error was routed to %s", next)
+	}
+
+	if _, ok := (nodeMap{}).errorRoute(errDeclined); ok {
+		t.Fatal("error was routed by node without error edges")
+	}
+}
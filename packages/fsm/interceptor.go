@@ -0,0 +1,67 @@
+package fsm
+
+import (
+	"github.com/pkg/errors"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// StepHandler invokes step for given node
+type StepHandler func(node NodeName, execCont *ExecutionContext) (NodeName, error)
+
+// Interceptor wraps step invocation, it must call next to proceed with the step
+// and may inspect or replace returned node and error
+type Interceptor func(node NodeName, execCont *ExecutionContext, next StepHandler) (NodeName, error)
+
+// Use registers interceptors which wrap every step of every graph,
+// it must be called before StartProcessing
+func (e *Executor) Use(interceptors ...Interceptor) {
+	e.interceptors = append(e.interceptors, interceptors...)
+}
+
+// stepHandler wraps step function with global and graph interceptors,
+// first registered interceptor is the outermost one
+func (e *Executor) stepHandler(graph storeEntry, function StepFunction) StepHandler {
+	handler := func(_ NodeName, execCont *ExecutionContext) (NodeName, error) {
+		return function(execCont)
+	}
+
+	interceptors := make([]Interceptor, 0, len(e.interceptors)+len(graph.options.Interceptors))
+	interceptors = append(interceptors, e.interceptors...)
+	interceptors = append(interceptors, graph.options.Interceptors...)
+
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(node NodeName, execCont *ExecutionContext) (NodeName, error) {
+			return interceptor(node, execCont, next)
+		}
+	}
+
+	return handler
+}
+
+// RecoverPanic converts step panic into step error
+func RecoverPanic(node NodeName, execCont *ExecutionContext, next StepHandler) (nextNode NodeName, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.Errorf("step %s panicked: %v\n%s", node, e, debug.Stack())
+		}
+	}()
+
+	return next(node, execCont)
+}
+
+// LogSteps logs every step invocation with its duration and outcome
+func LogSteps(node NodeName, execCont *ExecutionContext, next StepHandler) (NodeName, error) {
+	start := time.Now()
+	nextNode, err := next(node, execCont)
+
+	if err != nil {
+		log.Printf("Job %s step %s failed in %s: %v", execCont.JobId, node, time.Since(start), err)
+	} else {
+		log.Printf("Job %s step %s proceeded to %s in %s", execCont.JobId, node, nextNode, time.Since(start))
+	}
+
+	return nextNode, err
+}
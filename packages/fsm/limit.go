@@ -0,0 +1,282 @@
+package fsm
+
+import (
+	"context"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+	"github.com/pkg/errors"
+	"log"
+	"sort"
+	"sync"
+)
+
+type LimitKind string
+
+var (
+	GraphLimit LimitKind = "graph"
+	NodeLimit  LimitKind = "node"
+)
+
+// LimitUsage shows how much of concurrency limit is used at the moment
+type LimitUsage struct {
+	Kind  LimitKind `json:"kind"`
+	Graph string    `json:"graph"`
+	Node  NodeName  `json:"node,omitempty"`
+	Limit int       `json:"limit"`
+	// Used includes slots which are handed over to parked jobs, but weren't taken by them yet
+	Used    int `json:"used"`
+	Waiting int `json:"waiting"`
+}
+
+// LimitLister shows usage of concurrency limits
+type LimitLister interface {
+	ListLimits() []LimitUsage
+}
+
+// waiter is either job parked until slot is free, or step blocked until then
+type waiter struct {
+	jobId    string
+	priority storage.Priority
+	ready    chan struct{}
+}
+
+// limit is FIFO semaphore, waiters are served in order of arrival
+type limit struct {
+	mux      sync.Mutex
+	max      int
+	used     int
+	line     []*waiter
+	reserved map[string]bool
+	// delivers parked job when slot is handed over to it
+	deliver func(jobId string, priority storage.Priority)
+}
+
+// acquire takes slot for the job or puts it in line, slot is handed over and job is delivered again later on
+func (l *limit) acquire(jobId string, priority storage.Priority) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.reserved[jobId] {
+		delete(l.reserved, jobId)
+		return true
+	}
+
+	if l.used < l.max && len(l.line) == 0 {
+		l.used++
+		return true
+	}
+
+	for _, w := range l.line {
+		if w.jobId == jobId {
+			return false
+		}
+	}
+
+	l.line = append(l.line, &waiter{jobId: jobId, priority: priority})
+
+	return false
+}
+
+// wait blocks until slot is free or context is done
+func (l *limit) wait(ctx context.Context) error {
+	l.mux.Lock()
+
+	if l.used < l.max && len(l.line) == 0 {
+		l.used++
+		l.mux.Unlock()
+		return nil
+	}
+
+	w := &waiter{ready: make(chan struct{})}
+	l.line = append(l.line, w)
+	l.mux.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.mux.Lock()
+	for i, queued := range l.line {
+		if queued == w {
+			l.line = append(l.line[:i], l.line[i+1:]...)
+			l.mux.Unlock()
+			return ctx.Err()
+		}
+	}
+	l.mux.Unlock()
+
+	// slot was handed over concurrently, so it has to be passed on
+	l.release()
+
+	return ctx.Err()
+}
+
+// release frees slot or hands it over to the first waiter
+func (l *limit) release() {
+	l.mux.Lock()
+
+	if len(l.line) == 0 {
+		l.used--
+		l.mux.Unlock()
+		return
+	}
+
+	w := l.line[0]
+	l.line = l.line[1:]
+
+	if w.ready != nil {
+		close(w.ready)
+		l.mux.Unlock()
+		return
+	}
+
+	l.reserved[w.jobId] = true
+	l.mux.Unlock()
+
+	go l.deliver(w.jobId, w.priority)
+}
+
+// forfeit frees slot which was handed over to job that can't be executed anymore
+func (l *limit) forfeit(jobId string) {
+	l.mux.Lock()
+	reserved := l.reserved[jobId]
+	delete(l.reserved, jobId)
+	l.mux.Unlock()
+
+	if reserved {
+		l.release()
+	}
+}
+
+func (l *limit) usage() LimitUsage {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	return LimitUsage{
+		Limit:   l.max,
+		Used:    l.used,
+		Waiting: len(l.line),
+	}
+}
+
+type limitKey struct {
+	graph string
+	node  NodeName
+}
+
+// limits hold concurrency limits of graphs and their nodes, limits are shared by all versions of the graph
+type limits struct {
+	mux    sync.RWMutex
+	limits map[limitKey]*limit
+}
+
+func (ls *limits) get(key limitKey) *limit {
+	ls.mux.RLock()
+	defer ls.mux.RUnlock()
+
+	return ls.limits[key]
+}
+
+// setLimit sets limit of graph or node, last registered graph version wins
+func (e *Executor) setLimit(key limitKey, max int) {
+	e.limits.mux.Lock()
+	defer e.limits.mux.Unlock()
+
+	existing, ok := e.limits.limits[key]
+
+	if max <= 0 {
+		// jobs which already wait for the slot keep waiting for it
+		if ok && existing.usage().Waiting == 0 {
+			delete(e.limits.limits, key)
+		}
+		return
+	}
+
+	if ok {
+		existing.mux.Lock()
+		existing.max = max
+		existing.mux.Unlock()
+		return
+	}
+
+	e.limits.limits[key] = &limit{
+		max:      max,
+		reserved: make(map[string]bool),
+		deliver:  e.redeliver,
+	}
+}
+
+// setLimits registers limits of the graph and its nodes
+func (e *Executor) setLimits(name string, sm stepMap, options GraphOptions) {
+	e.setLimit(limitKey{graph: name}, options.MaxConcurrency)
+
+	for node, executor := range sm {
+		e.setLimit(limitKey{graph: name, node: node}, executor.options.MaxConcurrency)
+	}
+}
+
+// acquireGraph takes slot of graph limit for the job. Child job waits for it, since its parent is executed already,
+// other jobs are put in line and delivered again when slot is free.
+func (e *Executor) acquireGraph(ctx context.Context, graphLimit *limit, job *storage.Object) (bool, error) {
+	id := job.ID.(string)
+
+	if job.ParentId != "" {
+		if err := graphLimit.wait(ctx); err != nil {
+			return false, errors.Wrapf(err, "child job %s stopped while waiting for graph %s", id, job.CommandGraph)
+		}
+
+		return true, nil
+	}
+
+	if graphLimit.acquire(id, job.Priority) {
+		return true, nil
+	}
+
+	log.Printf("Job %s waits for concurrency slot of graph %s", id, job.CommandGraph)
+
+	// queued job is delivered again after crash, unlike initial one. Waiting job is recovered once its time has passed.
+	if job.Status == storage.Initial {
+		if _, err := e.storage.QueueJob(id, job.Status); err != nil {
+			log.Printf("Couldn't queue job %s: %v", id, err)
+		}
+	}
+
+	return false, errSkipped
+}
+
+func (e *Executor) redeliver(jobId string, priority storage.Priority) {
+	log.Printf("Job %s got its concurrency slot", jobId)
+	e.lane(priority) <- jobId
+}
+
+// ListLimits shows usage of every concurrency limit
+func (e *Executor) ListLimits() []LimitUsage {
+	e.limits.mux.RLock()
+	defer e.limits.mux.RUnlock()
+
+	result := make([]LimitUsage, 0, len(e.limits.limits))
+
+	for key, l := range e.limits.limits {
+		usage := l.usage()
+		usage.Graph = key.graph
+		usage.Node = key.node
+		usage.Kind = GraphLimit
+
+		if key.node != "" {
+			usage.Kind = NodeLimit
+		}
+
+		result = append(result, usage)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Graph != result[j].Graph {
+			return result[i].Graph < result[j].Graph
+		}
+
+		return result[i].Node < result[j].Node
+	})
+
+	return result
+}
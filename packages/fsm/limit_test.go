@@ -0,0 +1,190 @@
+package fsm_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/fsmtest"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+// eventually polls condition until it holds or second passes
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s didn't happen in time", what)
+		}
+
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func usage(e *fsm.Executor, kind fsm.LimitKind) fsm.LimitUsage {
+	for _, l := range e.ListLimits() {
+		if l.Kind == kind {
+			return l
+		}
+	}
+
+	return fsm.LimitUsage{}
+}
+
+func countStatus(t *testing.T, repository *storage.Repository, ids []string, status storage.Status) int {
+	t.Helper()
+
+	count := 0
+
+	for _, id := range ids {
+		job, err := repository.FindById(id)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if job.Status == status {
+			count++
+		}
+	}
+
+	return count
+}
+
+func TestConcurrencyLimits(t *testing.T) {
+	gate := make(chan struct{})
+	repository := fsmtest.NewStorage()
+	executor := fsm.NewExecutor(repository, &sync.Map{}, 4)
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Prepare", []fsm.NodeName{"Call"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		<-gate
+		return "Call", nil
+	})
+	sm.AddStepWithOptions("Call", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		<-gate
+		return "", nil
+	}, fsm.StepOptions{MaxConcurrency: 1})
+
+	if err := executor.AddControlGraphWithOptions("Limited", sm, fsm.GraphOptions{MaxConcurrency: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	go executor.StartProcessing()
+	defer close(executor.ExecutorChannel)
+
+	ids := make([]string, 0)
+
+	for i := 0; i < 3; i++ {
+		job, err := repository.CreateJob(storage.ObjectDTO{CommandGraph: "Limited", Status: storage.Initial})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, job.ID.(string))
+		executor.ExecutorChannel <- job.ID.(string)
+	}
+
+	// the third job is parked without holding executor until graph slot is free
+	eventually(t, "parking of the job over graph limit", func() bool {
+		graph := usage(executor, fsm.GraphLimit)
+		return graph.Used == 2 && graph.Waiting == 1 && countStatus(t, repository, ids, storage.Queued) == 1
+	})
+
+	gate <- struct{}{}
+	gate <- struct{}{}
+
+	// both jobs have prepared, but only one of them may call at once
+	eventually(t, "waiting for node slot", func() bool {
+		node := usage(executor, fsm.NodeLimit)
+		return node.Used == 1 && node.Waiting == 1
+	})
+
+	for i := 0; i < 4; i++ {
+		gate <- struct{}{}
+	}
+
+	eventually(t, "completion of every job", func() bool {
+		return countStatus(t, repository, ids, storage.Completed) == len(ids)
+	})
+
+	if graph, node := usage(executor, fsm.GraphLimit), usage(executor, fsm.NodeLimit); graph.Used != 0 || node.Used != 0 {
+		t.Fatalf("slots weren't released: graph %+v, node %+v", graph, node)
+	}
+}
+
+func TestRecoverWokenJobOverGraphLimit(t *testing.T) {
+	h := fsmtest.New(t)
+	gate := make(chan struct{})
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Start", []fsm.NodeName{"Sync"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		if _, hold := ec.GetParam("hold"); hold {
+			<-gate
+			return "", nil
+		}
+
+		return ec.ContinueAfter("Sync", time.Hour), nil
+	})
+	sm.AddStep("Sync", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraphWithOptions("Sync", sm, fsm.GraphOptions{MaxConcurrency: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	parked := h.Run("Sync", nil).AssertStatus(storage.Waiting)
+
+	holding := make(chan *fsmtest.Job)
+	go func() {
+		holding <- h.Run("Sync", map[string]interface{}{"hold": true})
+	}()
+
+	eventually(t, "taking of graph slot", func() bool {
+		return usage(h.Executor, fsm.GraphLimit).Used == 1
+	})
+
+	// woken job waits in line, its timer is gone
+	parked.Advance(time.Hour).AssertStatus(storage.Waiting)
+
+	if waiting := usage(h.Executor, fsm.GraphLimit).Waiting; waiting != 1 {
+		t.Fatalf("%d jobs wait for graph slot", waiting)
+	}
+
+	close(gate)
+	(<-holding).AssertStatus(storage.Completed)
+
+	// slot is handed over to the woken job, but process stops before executing it
+	if id := <-h.Executor.ExecutorChannel; id != parked.ID {
+		t.Fatalf("job %s got graph slot instead of %s", id, parked.ID)
+	}
+
+	parked.AssertStatus(storage.Waiting)
+
+	restarted := fsm.NewExecutor(h.Repository, h.Dependencies, 1)
+	restarted.SetClock(h.Now)
+
+	if err := restarted.AddControlGraphWithOptions("Sync", sm, fsm.GraphOptions{MaxConcurrency: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if recovered, err := restarted.RecoverJobs(); err != nil || recovered != 1 {
+		t.Fatalf("%d jobs were recovered: %v", recovered, err)
+	}
+
+	if id := <-restarted.ExecutorChannel; id != parked.ID {
+		t.Fatalf("job %s was recovered instead of %s", id, parked.ID)
+	}
+
+	if err := restarted.RunJob(parked.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	parked.AssertStatus(storage.Completed).AssertPath("Start", "Sync")
+}
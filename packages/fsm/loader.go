@@ -0,0 +1,210 @@
+package fsm
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// FunctionRegistry maps names used in graph definitions to step functions and sentinel errors.
+// It must be filled before graphs are loaded.
+type FunctionRegistry struct {
+	functions map[string]StepFunction
+	errors    map[string]error
+}
+
+func NewFunctionRegistry() *FunctionRegistry {
+	return &FunctionRegistry{
+		functions: make(map[string]StepFunction),
+		errors:    make(map[string]error),
+	}
+}
+
+func (fr *FunctionRegistry) Register(name string, function StepFunction) {
+	fr.functions[name] = function
+}
+
+// RegisterError makes sentinel error available to error edges of graph definitions
+func (fr *FunctionRegistry) RegisterError(name string, err error) {
+	fr.errors[name] = err
+}
+
+// GraphDefinition describes control graph topology, durations are written in time.ParseDuration format
+type GraphDefinition struct {
+	Name           string                      `json:"name" yaml:"name"`
+	Version        string                      `json:"version" yaml:"version"`
+	Root           NodeName                    `json:"root" yaml:"root"`
+	EntryPoints    []NodeName                  `json:"entryPoints" yaml:"entryPoints"`
+	Timeout        string                      `json:"timeout" yaml:"timeout"`
+	MaxConcurrency int                         `json:"maxConcurrency" yaml:"maxConcurrency"`
+	Nodes          map[NodeName]NodeDefinition `json:"nodes" yaml:"nodes"`
+}
+
+// NodeDefinition describes single node, node without function is terminal one
+type NodeDefinition struct {
+	Function       string                `json:"function" yaml:"function"`
+	DryRun         string                `json:"dryRun" yaml:"dryRun"`
+	Children       []NodeName            `json:"children" yaml:"children"`
+	Timeout        string                `json:"timeout" yaml:"timeout"`
+	MaxConcurrency int                   `json:"maxConcurrency" yaml:"maxConcurrency"`
+	Errors         []ErrorEdgeDefinition `json:"errors" yaml:"errors"`
+}
+
+// ErrorEdgeDefinition routes registered sentinel error to node, empty error matches every error
+type ErrorEdgeDefinition struct {
+	Error string   `json:"error" yaml:"error"`
+	Node  NodeName `json:"node" yaml:"node"`
+}
+
+// ReadGraphDefinition reads definition from .json, .yaml or .yml file
+func ReadGraphDefinition(path string) (*GraphDefinition, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	definition := new(GraphDefinition)
+
+	switch filepath.Ext(path) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(definition)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, definition)
+	default:
+		return nil, errors.Errorf("unsupported graph definition format of %s", path)
+	}
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse graph definition %s", path)
+	}
+
+	if definition.Name == "" {
+		return nil, errors.Errorf("graph definition %s has no name", path)
+	}
+
+	return definition, nil
+}
+
+func parseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+// Build resolves functions and errors of the definition via registry
+func (gd *GraphDefinition) Build(registry *FunctionRegistry) (stepMap, GraphOptions, error) {
+	sm := NewStepMap()
+
+	timeout, err := parseDuration(gd.Timeout)
+	if err != nil {
+		return nil, GraphOptions{}, errors.Wrapf(err, "invalid timeout of graph %s", gd.Name)
+	}
+
+	options := GraphOptions{
+		Version:        gd.Version,
+		Root:           gd.Root,
+		EntryPoints:    gd.EntryPoints,
+		Timeout:        timeout,
+		MaxConcurrency: gd.MaxConcurrency,
+	}
+
+	if gd.Root != "" {
+		if _, ok := gd.Nodes[gd.Root]; !ok {
+			return nil, options, errors.Errorf("root %s of graph %s is not defined", gd.Root, gd.Name)
+		}
+	}
+
+	for _, entryPoint := range gd.EntryPoints {
+		if _, ok := gd.Nodes[entryPoint]; !ok {
+			return nil, options, errors.Errorf("entry point %s of graph %s is not defined", entryPoint, gd.Name)
+		}
+	}
+
+	for name, node := range gd.Nodes {
+		for _, child := range node.Children {
+			if _, ok := gd.Nodes[child]; !ok {
+				return nil, options, errors.Errorf("child %s of node %s is not defined", child, name)
+			}
+		}
+
+		if node.Function == "" {
+			if len(node.Children) > 0 || len(node.Errors) > 0 {
+				return nil, options, errors.Errorf("node %s has edges but no function", name)
+			}
+
+			continue
+		}
+
+		function, ok := registry.functions[node.Function]
+		if !ok {
+			return nil, options, errors.Errorf("function %s of node %s is not registered", node.Function, name)
+		}
+
+		var dryRun StepFunction
+		if node.DryRun != "" {
+			if dryRun, ok = registry.functions[node.DryRun]; !ok {
+				return nil, options, errors.Errorf("dry run function %s of node %s is not registered", node.DryRun, name)
+			}
+		}
+
+		stepTimeout, err := parseDuration(node.Timeout)
+		if err != nil {
+			return nil, options, errors.Wrapf(err, "invalid timeout of node %s", name)
+		}
+
+		edges := make([]ErrorEdge, 0, len(node.Errors))
+
+		for _, edge := range node.Errors {
+			if _, ok := gd.Nodes[edge.Node]; !ok {
+				return nil, options, errors.Errorf("error handler %s of node %s is not defined", edge.Node, name)
+			}
+
+			if edge.Error == "" {
+				edges = append(edges, OnAnyError(edge.Node))
+				continue
+			}
+
+			target, ok := registry.errors[edge.Error]
+			if !ok {
+				return nil, options, errors.Errorf("error %s of node %s is not registered", edge.Error, name)
+			}
+
+			edges = append(edges, OnError(target, edge.Node))
+		}
+
+		sm.AddStepWithOptions(name, node.Children, function, StepOptions{
+			Timeout:        stepTimeout,
+			ErrorEdges:     edges,
+			MaxConcurrency: node.MaxConcurrency,
+			DryRun:         dryRun,
+		})
+	}
+
+	return sm, options, nil
+}
+
+// LoadControlGraph reads graph definition from file and registers it as any other control graph
+func (e *Executor) LoadControlGraph(path string, registry *FunctionRegistry) error {
+	definition, err := ReadGraphDefinition(path)
+
+	if err != nil {
+		return err
+	}
+
+	sm, options, err := definition.Build(registry)
+
+	if err != nil {
+		return errors.Wrapf(err, "couldn't build graph definition %s", path)
+	}
+
+	return e.AddControlGraphWithOptions(definition.Name, sm, options)
+}
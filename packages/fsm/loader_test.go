@@ -0,0 +1,193 @@
+package fsm_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/fsmtest"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+func orderRegistry() *fsm.FunctionRegistry {
+	next := func(node fsm.NodeName) fsm.StepFunction {
+		return func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+			return node, nil
+		}
+	}
+
+	registry := fsm.NewFunctionRegistry()
+	registry.RegisterError("declined", errDeclined)
+	registry.Register("reserve", next("Charge"))
+	registry.Register("charge", func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		if _, declined := ec.GetParam("declined"); declined {
+			return "", errDeclined
+		}
+
+		return "Ship", nil
+	})
+	registry.Register("chargeDryRun", func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		ec.SetOutput("dry run")
+		return "Ship", nil
+	})
+	registry.Register("ship", next(""))
+	registry.Register("cancel", next(""))
+
+	return registry
+}
+
+func TestLoadControlGraph(t *testing.T) {
+	for _, path := range []string{"testdata/graphs/order.yaml", "testdata/graphs/order.json"} {
+		t.Run(path, func(t *testing.T) {
+			h := fsmtest.New(t)
+
+			if err := h.Executor.LoadControlGraph(path, orderRegistry()); err != nil {
+				t.Fatal(err)
+			}
+
+			job := h.Run("Order", nil).AssertStatus(storage.Completed).AssertPath("Reserve", "Charge", "Ship")
+
+			if obj := job.Object(); obj.GraphVersion != "v2" || !obj.Deadline.Equal(h.Now().Add(time.Minute)) {
+				t.Fatalf("job has version %q and deadline %v", obj.GraphVersion, obj.Deadline)
+			}
+
+			h.Run("Order", map[string]interface{}{"declined": true}).
+				AssertStatus(storage.Completed).
+				AssertPath("Reserve", "Charge", "Cancel")
+
+			h.RunJob(storage.ObjectDTO{CommandGraph: "Order", EntryPoint: "Charge"}).
+				AssertStatus(storage.Completed).
+				AssertPath("Charge", "Ship")
+
+			result, err := h.Executor.Simulate("Order", fsm.SimulationOptions{
+				EntryPoint: "Charge",
+				Stubs:      map[fsm.NodeName]fsm.StepStub{"Ship": {}},
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Status != storage.Completed || result.Output != "dry run" {
+				t.Fatalf("simulation has %s status and output %v", result.Status, result.Output)
+			}
+		})
+	}
+}
+
+func TestReadGraphDefinitionErrors(t *testing.T) {
+	cases := map[string]string{
+		"testdata/graphs/unknown_field.yaml": "retries",
+		"testdata/graphs/unknown_field.json": "retries",
+		"testdata/graphs/unnamed.yml":        "has no name",
+		"testdata/graphs/order.toml":         "unsupported",
+		"testdata/graphs/missing.yaml":       "no such file",
+	}
+
+	for path, expected := range cases {
+		t.Run(path, func(t *testing.T) {
+			_, err := fsm.ReadGraphDefinition(path)
+
+			if err == nil || !strings.Contains(err.Error(), expected) {
+				t.Fatalf("definition was read with %v, expected %q", err, expected)
+			}
+		})
+	}
+}
+
+func TestBuildGraphDefinitionErrors(t *testing.T) {
+	step := func(function string, children ...fsm.NodeName) fsm.NodeDefinition {
+		return fsm.NodeDefinition{Function: function, Children: children}
+	}
+
+	cases := []struct {
+		name       string
+		definition fsm.GraphDefinition
+		expected   string
+	}{
+		{
+			name: "unknown function",
+			definition: fsm.GraphDefinition{Nodes: map[fsm.NodeName]fsm.NodeDefinition{
+				"Reserve": step("book"),
+			}},
+			expected: "function book of node Reserve is not registered",
+		},
+		{
+			name: "unknown dry run function",
+			definition: fsm.GraphDefinition{Nodes: map[fsm.NodeName]fsm.NodeDefinition{
+				"Charge": {Function: "charge", DryRun: "fakeCharge"},
+			}},
+			expected: "dry run function fakeCharge of node Charge is not registered",
+		},
+		{
+			name: "unknown error",
+			definition: fsm.GraphDefinition{Nodes: map[fsm.NodeName]fsm.NodeDefinition{
+				"Charge": {Function: "charge", Errors: []fsm.ErrorEdgeDefinition{{Error: "expired", Node: "Cancel"}}},
+				"Cancel": step("cancel"),
+			}},
+			expected: "error expired of node Charge is not registered",
+		},
+		{
+			name: "undefined child",
+			definition: fsm.GraphDefinition{Nodes: map[fsm.NodeName]fsm.NodeDefinition{
+				"Reserve": step("reserve", "Charge"),
+			}},
+			expected: "child Charge of node Reserve is not defined",
+		},
+		{
+			name: "undefined error handler",
+			definition: fsm.GraphDefinition{Nodes: map[fsm.NodeName]fsm.NodeDefinition{
+				"Charge": {Function: "charge", Errors: []fsm.ErrorEdgeDefinition{{Node: "Cancel"}}},
+			}},
+			expected: "error handler Cancel of node Charge is not defined",
+		},
+		{
+			name: "undefined root",
+			definition: fsm.GraphDefinition{Root: "Start", Nodes: map[fsm.NodeName]fsm.NodeDefinition{
+				"Reserve": step("reserve"),
+			}},
+			expected: "root Start of graph Order is not defined",
+		},
+		{
+			name: "undefined entry point",
+			definition: fsm.GraphDefinition{EntryPoints: []fsm.NodeName{"Refund"}, Nodes: map[fsm.NodeName]fsm.NodeDefinition{
+				"Reserve": step("reserve"),
+			}},
+			expected: "entry point Refund of graph Order is not defined",
+		},
+		{
+			name: "edges without function",
+			definition: fsm.GraphDefinition{Nodes: map[fsm.NodeName]fsm.NodeDefinition{
+				"Reserve": step("", "Ship"),
+				"Ship":    step("ship"),
+			}},
+			expected: "node Reserve has edges but no function",
+		},
+		{
+			name: "bad graph timeout",
+			definition: fsm.GraphDefinition{Timeout: "a minute", Nodes: map[fsm.NodeName]fsm.NodeDefinition{
+				"Reserve": step("reserve"),
+			}},
+			expected: "invalid timeout of graph Order",
+		},
+		{
+			name: "bad node timeout",
+			definition: fsm.GraphDefinition{Nodes: map[fsm.NodeName]fsm.NodeDefinition{
+				"Reserve": {Function: "reserve", Timeout: "5"},
+			}},
+			expected: "invalid timeout of node Reserve",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.definition.Name = "Order"
+			_, _, err := c.definition.Build(orderRegistry())
+
+			if err == nil || !strings.Contains(err.Error(), c.expected) {
+				t.Fatalf("definition was built with %v, expected %q", err, c.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package fsm
+
+import "time"
+
+// Observer receives executor lifecycle events. Callbacks are invoked synchronously
+// from executor goroutines, so they must be fast and concurrency safe.
+type Observer interface {
+	JobReceived(jobId string)
+	JobStarted(jobId string, graph string, node NodeName)
+	StepStarted(jobId string, node NodeName)
+	StepFinished(jobId string, node NodeName, next NodeName, err error, duration time.Duration)
+	JobCompleted(jobId string)
+	JobFailed(jobId string, err error)
+	UnknownGraph(jobId string, graph string)
+}
+
+// NopObserver ignores every event, embed it to implement only needed callbacks
+type NopObserver struct{}
+
+func (NopObserver) JobReceived(string)                                            {}
+func (NopObserver) JobStarted(string, string, NodeName)                           {}
+func (NopObserver) StepStarted(string, NodeName)                                  {}
+func (NopObserver) StepFinished(string, NodeName, NodeName, error, time.Duration) {}
+func (NopObserver) JobCompleted(string)                                           {}
+func (NopObserver) JobFailed(string, error)                                       {}
+func (NopObserver) UnknownGraph(string, string)                                   {}
+
+// observers notifies every registered observer in order of registration
+type observers []Observer
+
+func (o observers) JobReceived(jobId string) {
+	for _, observer := range o {
+		observer.JobReceived(jobId)
+	}
+}
+
+func (o observers) JobStarted(jobId string, graph string, node NodeName) {
+	for _, observer := range o {
+		observer.JobStarted(jobId, graph, node)
+	}
+}
+
+func (o observers) StepStarted(jobId string, node NodeName) {
+	for _, observer := range o {
+		observer.StepStarted(jobId, node)
+	}
+}
+
+func (o observers) StepFinished(jobId string, node NodeName, next NodeName, err error, duration time.Duration) {
+	for _, observer := range o {
+		observer.StepFinished(jobId, node, next, err, duration)
+	}
+}
+
+func (o observers) JobCompleted(jobId string) {
+	for _, observer := range o {
+		observer.JobCompleted(jobId)
+	}
+}
+
+func (o observers) JobFailed(jobId string, err error) {
+	for _, observer := range o {
+		observer.JobFailed(jobId, err)
+	}
+}
+
+func (o observers) UnknownGraph(jobId string, graph string) {
+	for _, observer := range o {
+		observer.UnknownGraph(jobId, graph)
+	}
+}
+
+// AddObserver registers lifecycle observer, it must be called before StartProcessing
+func (e *Executor) AddObserver(observer Observer) {
+	e.observers = append(e.observers, observer)
+}
@@ -0,0 +1,130 @@
+package fsm_test
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/fsmtest"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+func TestPauseAtCheckpoint(t *testing.T) {
+	h := fsmtest.New(t)
+	var exported int32
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Export", []fsm.NodeName{"Notify"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		atomic.AddInt32(&exported, 1)
+
+		// running job is only marked, it's paused before its next step
+		if ok, err := h.Repository.PauseJob(ec.JobId, storage.Processing); !ok || err != nil {
+			t.Errorf("pause wasn't requested: %v", err)
+		}
+
+		return "Notify", nil
+	})
+	sm.AddStep("Notify", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Export", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Export", nil).AssertStatus(storage.Paused).AssertPath("Export")
+
+	// paused job isn't executed on delivery
+	if err := h.Executor.RunJob(job.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	job.AssertStatus(storage.Paused)
+
+	if ok, err := h.Repository.ResumeJob(job.ID, storage.Paused); !ok || err != nil {
+		t.Fatalf("job wasn't resumed: %v", err)
+	}
+
+	if err := h.Executor.RunJob(job.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	job.AssertStatus(storage.Completed).AssertPath("Export", "Notify")
+
+	if exported := atomic.LoadInt32(&exported); exported != 1 {
+		t.Fatalf("export was executed %d times", exported)
+	}
+}
+
+func TestWithdrawPauseRequest(t *testing.T) {
+	h := fsmtest.New(t)
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Export", []fsm.NodeName{"Notify"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		if ok, err := h.Repository.PauseJob(ec.JobId, storage.Processing); !ok || err != nil {
+			t.Errorf("pause wasn't requested: %v", err)
+		}
+
+		// operator has changed their mind before the job reached its checkpoint
+		if ok, err := h.Repository.ResumeJob(ec.JobId, storage.Processing); !ok || err != nil {
+			t.Errorf("pause request wasn't withdrawn: %v", err)
+		}
+
+		return "Notify", nil
+	})
+	sm.AddStep("Notify", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Export", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Run("Export", nil).AssertStatus(storage.Completed).AssertPath("Export", "Notify")
+}
+
+func TestPauseInitialJob(t *testing.T) {
+	h := fsmtest.New(t)
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Export", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Export", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := h.Repository.CreateJob(storage.ObjectDTO{CommandGraph: "Export", Status: storage.Initial})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := obj.ID.(string)
+
+	// job which isn't executed is paused right away
+	if ok, err := h.Repository.PauseJob(id, storage.Initial); !ok || err != nil {
+		t.Fatalf("job wasn't paused: %v", err)
+	}
+
+	if err := h.Executor.RunJob(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if obj, _ := h.Repository.FindById(id); obj.Status != storage.Paused || len(obj.Checkins) != 0 {
+		t.Fatalf("job has %s status and checkins %v", obj.Status, obj.Checkins)
+	}
+
+	if ok, err := h.Repository.ResumeJob(id, storage.Paused); !ok || err != nil {
+		t.Fatalf("job wasn't resumed: %v", err)
+	}
+
+	if err := h.Executor.RunJob(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if obj, _ := h.Repository.FindById(id); obj.Status != storage.Completed {
+		t.Fatalf("resumed job has %s status", obj.Status)
+	}
+}
@@ -0,0 +1,120 @@
+package fsm
+
+import (
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+	"sync"
+)
+
+// starvationLimit is how many jobs of higher priorities may be taken in a row
+// before waiting job of lower priority is taken
+const starvationLimit = 10
+
+// intake holds channel of every priority besides the normal one, which is ExecutorChannel
+type intake struct {
+	mux     sync.Mutex
+	lanes   map[storage.Priority]chan string
+	skipped map[storage.Priority]int
+}
+
+func newIntake() *intake {
+	lanes := make(map[storage.Priority]chan string)
+
+	for _, priority := range storage.Priorities {
+		if priority != storage.NormalPriority {
+			lanes[priority] = make(chan string)
+		}
+	}
+
+	return &intake{
+		lanes:   lanes,
+		skipped: make(map[storage.Priority]int),
+	}
+}
+
+// Channel returns channel jobs of given priority are delivered to, unknown priority is treated as normal one
+func (e *Executor) Channel(priority storage.Priority) chan<- string {
+	return e.lane(priority)
+}
+
+// Channels returns channels of all known priorities
+func (e *Executor) Channels() map[storage.Priority]chan<- string {
+	channels := make(map[storage.Priority]chan<- string, len(storage.Priorities))
+
+	for _, priority := range storage.Priorities {
+		channels[priority] = e.lane(priority)
+	}
+
+	return channels
+}
+
+func (e *Executor) lane(priority storage.Priority) chan string {
+	if lane, ok := e.intake.lanes[priority]; ok {
+		return lane
+	}
+
+	return e.ExecutorChannel
+}
+
+// takeJob waits for the next job, jobs of higher priority are taken first unless lower priority
+// is starving. Returns false when ExecutorChannel is closed.
+func (e *Executor) takeJob() (string, bool) {
+	if id, ok := e.pollJob(); ok {
+		return id, true
+	}
+
+	select {
+	case id := <-e.lane(storage.HighPriority):
+		return id, true
+	case id, ok := <-e.ExecutorChannel:
+		return id, ok
+	case id := <-e.lane(storage.LowPriority):
+		return id, true
+	}
+}
+
+// pollJob takes job which is already waiting for executor, if any
+func (e *Executor) pollJob() (string, bool) {
+	e.intake.mux.Lock()
+	defer e.intake.mux.Unlock()
+
+	// starving priorities go first, starting from the lowest one
+	for i := len(storage.Priorities) - 1; i > 0; i-- {
+		priority := storage.Priorities[i]
+
+		if e.intake.skipped[priority] < starvationLimit {
+			continue
+		}
+
+		if id, ok := tryReceive(e.lane(priority)); ok {
+			e.intake.skipped[priority] = 0
+			return id, true
+		}
+	}
+
+	for i, priority := range storage.Priorities {
+		id, ok := tryReceive(e.lane(priority))
+
+		if !ok {
+			continue
+		}
+
+		e.intake.skipped[priority] = 0
+		for _, lower := range storage.Priorities[i+1:] {
+			e.intake.skipped[lower]++
+		}
+
+		return id, true
+	}
+
+	return "", false
+}
+
+// tryReceive reads channel without blocking, closed channel is left to takeJob
+func tryReceive(lane chan string) (string, bool) {
+	select {
+	case id, ok := <-lane:
+		return id, ok
+	default:
+		return "", false
+	}
+}
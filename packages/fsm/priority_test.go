@@ -0,0 +1,87 @@
+package fsm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+// bufferedExecutor has buffered intake, so jobs are waiting for executor before it takes them
+func bufferedExecutor(size int) *Executor {
+	e := NewExecutor(nil, nil, 1)
+	e.ExecutorChannel = make(chan string, size)
+
+	for priority := range e.intake.lanes {
+		e.intake.lanes[priority] = make(chan string, size)
+	}
+
+	return e
+}
+
+func takeJobs(t *testing.T, e *Executor, count int) string {
+	t.Helper()
+
+	taken := make([]string, 0, count)
+
+	for i := 0; i < count; i++ {
+		id, ok := e.takeJob()
+
+		if !ok {
+			t.Fatal("intake is closed")
+		}
+
+		taken = append(taken, id)
+	}
+
+	return strings.Join(taken, "")
+}
+
+func TestTakeJobByPriority(t *testing.T) {
+	e := bufferedExecutor(10)
+
+	e.Channel(storage.LowPriority) <- "l"
+	e.Channel(storage.NormalPriority) <- "n"
+	e.Channel(storage.HighPriority) <- "h"
+	e.Channel("unknown") <- "u"
+
+	if order := takeJobs(t, e, 4); order != "hnul" {
+		t.Fatalf("jobs were taken in order %s", order)
+	}
+}
+
+func TestTakeJobWithoutStarvation(t *testing.T) {
+	e := bufferedExecutor(20)
+
+	for i := 0; i < 15; i++ {
+		e.Channel(storage.HighPriority) <- "h"
+	}
+
+	e.Channel(storage.NormalPriority) <- "n"
+	e.Channel(storage.LowPriority) <- "l"
+
+	// lower priorities are taken once higher ones were taken starvationLimit times in a row
+	expected := strings.Repeat("h", starvationLimit) + "ln" + strings.Repeat("h", 15-starvationLimit)
+
+	if order := takeJobs(t, e, 17); order != expected {
+		t.Fatalf("jobs were taken in order %s, expected %s", order, expected)
+	}
+}
+
+func TestTakeJobWaits(t *testing.T) {
+	e := NewExecutor(nil, nil, 1)
+
+	go func() {
+		e.Channel(storage.LowPriority) <- "l"
+	}()
+
+	if order := takeJobs(t, e, 1); order != "l" {
+		t.Fatalf("job %s was taken", order)
+	}
+
+	close(e.ExecutorChannel)
+
+	if _, ok := e.takeJob(); ok {
+		t.Fatal("job was taken from closed intake")
+	}
+}
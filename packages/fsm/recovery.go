@@ -0,0 +1,158 @@
+package fsm
+
+import (
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+	"github.com/pkg/errors"
+	"log"
+)
+
+// ResumePolicy tells what to do with job which was interrupted in the middle of the step
+type ResumePolicy string
+
+var (
+	// ResumeRerun is used by default, step is considered safe to be executed again
+	ResumeRerun ResumePolicy = "rerun"
+	// ResumeManual marks job as interrupted, so operator has to decide whether to resume it via RecoverJob
+	ResumeManual ResumePolicy = "manual"
+)
+
+// errInterrupted stops job whose step requires operator decision, job is resumed only via RecoverJob
+var errInterrupted = errors.New("job is interrupted")
+
+// interruptedStep returns step that can't be safely re-run, if job was stopped inside of it
+func interruptedStep(job *storage.Object, sm stepMap) (NodeName, bool) {
+	current := NodeName(job.CurrentStep)
+	node, ok := sm[current]
+
+	if !ok {
+		return "", false
+	}
+
+	if node.fanOut == nil {
+		return current, node.options.Resume == ResumeManual
+	}
+
+	// fan out is re-run as a whole, so every unfinished branch has to be checked
+	for _, branch := range job.Branches {
+		if branch.Status != storage.Processing {
+			continue
+		}
+
+		step := NodeName(branch.CurrentStep)
+		if sm[step].options.Resume == ResumeManual {
+			return step, true
+		}
+	}
+
+	return "", false
+}
+
+// RecoverJobs finds jobs which were left in processing state, e.g. after crash, and resumes them
+// from their last checkpoint. Jobs stopped inside of steps with ResumeManual policy are marked as interrupted.
+// Queued jobs which weren't delivered to executor are resumed as well, and so are waiting jobs whose time
+// has come, since their timer may be gone. Child jobs are resumed by their parents.
+// It must not be called while another executor is processing jobs from the same storage.
+func (e *Executor) RecoverJobs() (int, error) {
+	jobs, err := e.storage.FindByStatus(storage.Processing)
+
+	if err != nil {
+		return 0, errors.Wrap(err, "couldn't find jobs to recover")
+	}
+
+	queued, err := e.storage.FindByStatus(storage.Queued)
+
+	if err != nil {
+		return 0, errors.Wrap(err, "couldn't find jobs to recover")
+	}
+
+	waiting, err := e.storage.FindByStatus(storage.Waiting)
+
+	if err != nil {
+		return 0, errors.Wrap(err, "couldn't find jobs to recover")
+	}
+
+	recovered := make([]*storage.Object, 0, len(jobs)+len(queued)+len(waiting))
+
+	for _, job := range jobs {
+		if job.ParentId != "" {
+			continue
+		}
+
+		id := job.ID.(string)
+		graph, ok := e.executionStore.loadGraph(job.CommandGraph, job.GraphVersion)
+
+		if ok {
+			if step, manual := interruptedStep(job, graph.stepMap); manual {
+				err = e.storage.InterruptJob(id, errors.Errorf("step %s was interrupted and requires operator decision", step))
+				if err != nil {
+					log.Printf("Couldn't interrupt job %s: %v", id, err)
+				}
+				continue
+			}
+		}
+
+		// processing job isn't deliverable, it's queued so it can be claimed and resumed from its current step
+		if ok, err := e.storage.QueueJob(id, job.Status); err != nil || !ok {
+			log.Printf("Couldn't queue job %s: %v", id, err)
+			continue
+		}
+
+		recovered = append(recovered, job)
+	}
+
+	// delivered signal queues job before it's enqueued, so job stays queued if process stops in between
+	for _, job := range queued {
+		if job.ParentId == "" {
+			recovered = append(recovered, job)
+		}
+	}
+
+	// timer of the job was consumed while the job waited in line for concurrency slot
+	for _, job := range waiting {
+		if job.ParentId == "" && !job.WakeAt.IsZero() && !e.clock().Before(job.WakeAt) {
+			recovered = append(recovered, job)
+		}
+	}
+
+	go e.dispatch(recovered...)
+
+	return len(recovered), nil
+}
+
+// RecoverJob resumes single processing or interrupted job from its last checkpoint regardless of step resume policy.
+// Interrupted child job is resumed along with its parent.
+func (e *Executor) RecoverJob(id string) error {
+	job, err := e.storage.FindById(id)
+
+	if err != nil {
+		return err
+	}
+
+	if job.ParentId != "" {
+		return errors.Errorf("job %s is executed by its parent %s, recover the parent instead", id, job.ParentId)
+	}
+
+	if job.Status != storage.Processing && job.Status != storage.Interrupted {
+		return errors.Errorf("job %s can't be recovered from %s status", id, job.Status)
+	}
+
+	ok, err := e.storage.QueueJob(id, job.Status)
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errors.Errorf("job %s has changed its status concurrently", id)
+	}
+
+	go e.dispatch(job)
+
+	return nil
+}
+
+func (e *Executor) dispatch(jobs ...*storage.Object) {
+	for _, job := range jobs {
+		e.lane(job.Priority) <- job.ID.(string)
+	}
+}
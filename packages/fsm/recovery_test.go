@@ -0,0 +1,202 @@
+package fsm_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/fsmtest"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+// shipment counts executions of its steps, so tests can tell which of them were re-run
+type shipment struct {
+	runs map[fsm.NodeName]int
+}
+
+func (s *shipment) step(name fsm.NodeName, next fsm.NodeName) fsm.StepFunction {
+	return func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		s.runs[name]++
+		return next, nil
+	}
+}
+
+// register adds sequential shipment graph whose charge step has given options
+func (s *shipment) register(h *fsmtest.Harness, charge fsm.StepOptions) error {
+	sm := fsm.NewStepMap()
+	sm.AddStep("Reserve", []fsm.NodeName{"Charge"}, s.step("Reserve", "Charge"))
+	sm.AddStepWithOptions("Charge", []fsm.NodeName{"Ship"}, s.step("Charge", "Ship"), charge)
+	sm.AddStep("Ship", nil, s.step("Ship", ""))
+
+	return h.Executor.AddControlGraph("Shipment", sm)
+}
+
+// crashedAt leaves job in the state process has stopped in while executing given step
+func crashedAt(t *testing.T, h *fsmtest.Harness, graph string, step string) string {
+	t.Helper()
+
+	job, err := h.Repository.CreateJob(storage.ObjectDTO{CommandGraph: graph, Status: storage.Initial})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := job.ID.(string)
+
+	if ok, err := h.Repository.ClaimJob(id, storage.Initial, step); err != nil || !ok {
+		t.Fatalf("couldn't claim job %s: %v", id, err)
+	}
+
+	return id
+}
+
+// runRecovered executes job dispatched by recovery, the way executor's consumer would
+func runRecovered(t *testing.T, h *fsmtest.Harness, id string) {
+	t.Helper()
+
+	select {
+	case dispatched := <-h.Executor.ExecutorChannel:
+		if dispatched != id {
+			t.Fatalf("job %s was dispatched instead of %s", dispatched, id)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("job %s wasn't dispatched", id)
+	}
+
+	if err := h.Executor.RunJob(id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func findJob(t *testing.T, h *fsmtest.Harness, id string) *storage.Object {
+	t.Helper()
+
+	job, err := h.Repository.FindById(id)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return job
+}
+
+func TestRecoverProcessingJob(t *testing.T) {
+	h := fsmtest.New(t)
+	s := &shipment{runs: make(map[fsm.NodeName]int)}
+
+	if err := s.register(h, fsm.StepOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	id := crashedAt(t, h, "Shipment", "Charge")
+
+	if recovered, err := h.Executor.RecoverJobs(); err != nil || recovered != 1 {
+		t.Fatalf("%d jobs were recovered: %v", recovered, err)
+	}
+
+	runRecovered(t, h, id)
+
+	if job := findJob(t, h, id); job.Status != storage.Completed {
+		t.Fatalf("recovered job has %s status: %s", job.Status, job.Error)
+	}
+
+	if s.runs["Reserve"] != 0 || s.runs["Charge"] != 1 || s.runs["Ship"] != 1 {
+		t.Fatalf("steps were executed %v times", s.runs)
+	}
+}
+
+func TestRecoverManualStep(t *testing.T) {
+	h := fsmtest.New(t)
+	s := &shipment{runs: make(map[fsm.NodeName]int)}
+
+	if err := s.register(h, fsm.StepOptions{Resume: fsm.ResumeManual}); err != nil {
+		t.Fatal(err)
+	}
+
+	id := crashedAt(t, h, "Shipment", "Charge")
+
+	if recovered, err := h.Executor.RecoverJobs(); err != nil || recovered != 0 {
+		t.Fatalf("%d jobs were recovered: %v", recovered, err)
+	}
+
+	job := findJob(t, h, id)
+
+	if job.Status != storage.Interrupted || !strings.Contains(job.Error, "Charge") {
+		t.Fatalf("job has %s status: %s", job.Status, job.Error)
+	}
+
+	// operator has decided that charge may be repeated
+	if err := h.Executor.RecoverJob(id); err != nil {
+		t.Fatal(err)
+	}
+
+	runRecovered(t, h, id)
+
+	if job := findJob(t, h, id); job.Status != storage.Completed {
+		t.Fatalf("recovered job has %s status: %s", job.Status, job.Error)
+	}
+
+	if s.runs["Charge"] != 1 || s.runs["Ship"] != 1 {
+		t.Fatalf("steps were executed %v times", s.runs)
+	}
+}
+
+func TestRecoverFinishedJob(t *testing.T) {
+	h := fsmtest.New(t)
+	s := &shipment{runs: make(map[fsm.NodeName]int)}
+
+	if err := s.register(h, fsm.StepOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Shipment", nil).AssertStatus(storage.Completed)
+
+	if err := h.Executor.RecoverJob(job.ID); err == nil {
+		t.Fatal("completed job was recovered")
+	}
+}
+
+func TestRecoverFanOutBranchInManualStep(t *testing.T) {
+	h := fsmtest.New(t)
+	s := &shipment{runs: make(map[fsm.NodeName]int)}
+
+	sm := fsm.NewStepMap()
+	sm.AddFanOut("Split", []fsm.NodeName{"Label", "Charge"}, "Ship", fsm.JoinAll)
+	sm.AddStep("Label", []fsm.NodeName{"Ship"}, s.step("Label", "Ship"))
+	sm.AddStepWithOptions("Charge", []fsm.NodeName{"Ship"}, s.step("Charge", "Ship"), fsm.StepOptions{Resume: fsm.ResumeManual})
+	sm.AddStep("Ship", nil, s.step("Ship", ""))
+
+	if err := h.Executor.AddControlGraph("Shipment", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	id := crashedAt(t, h, "Shipment", "Split")
+
+	// label branch has finished, charge branch was stopped inside of manual step
+	for _, branch := range []string{"Label", "Charge"} {
+		if err := h.Repository.StartBranch(id, branch); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := h.Repository.CheckinBranch(id, branch, branch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := h.Repository.CompleteBranch(id, "Label"); err != nil {
+		t.Fatal(err)
+	}
+
+	if recovered, err := h.Executor.RecoverJobs(); err != nil || recovered != 0 {
+		t.Fatalf("%d jobs were recovered: %v", recovered, err)
+	}
+
+	if job := findJob(t, h, id); job.Status != storage.Interrupted || !strings.Contains(job.Error, "Charge") {
+		t.Fatalf("job has %s status: %s", job.Status, job.Error)
+	}
+
+	if len(s.runs) != 0 {
+		t.Fatalf("steps were executed %v times", s.runs)
+	}
+}
@@ -0,0 +1,79 @@
+package fsm
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy describes how failed step is retried before the job is failed
+type RetryPolicy struct {
+	// MaxAttempts includes the first invocation, values less than 2 disable retries
+	MaxAttempts int
+	// InitialBackoff is the delay before the second attempt
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay, zero means no cap
+	MaxBackoff time.Duration
+	// Multiplier is applied to the delay after each attempt, defaults to 2
+	Multiplier float64
+	// Jitter is a fraction of the delay which is randomly subtracted from it, between 0 and 1
+	Jitter float64
+	// Retryable classifies step errors, nil means that every error is retryable
+	Retryable func(err error) bool
+}
+
+func (rp *RetryPolicy) retryable(err error) bool {
+	if rp.Retryable == nil {
+		return true
+	}
+
+	return rp.Retryable(err)
+}
+
+// backoff returns delay to wait after given attempt
+func (rp *RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := rp.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+
+	delay := float64(rp.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+
+	if rp.MaxBackoff > 0 && delay > float64(rp.MaxBackoff) {
+		delay = float64(rp.MaxBackoff)
+	}
+
+	if rp.Jitter > 0 {
+		delay -= delay * math.Min(rp.Jitter, 1) * rand.Float64()
+	}
+
+	return time.Duration(delay)
+}
+
+// retryStep runs step according to its retry policy and records every attempt
+func (e *Executor) retryStep(ctx context.Context, name NodeName, node nodeMap, handler StepHandler, execCont *ExecutionContext) (NodeName, error) {
+	policy := node.options.Retry
+
+	for attempt := 1; ; attempt++ {
+		next, err := runStep(ctx, name, node.options.Timeout, handler, execCont)
+
+		if policy == nil {
+			return next, err
+		}
+
+		// inability to record attempt shouldn't cripple graph execution
+		_ = e.storage.RecordAttempt(execCont.JobId, string(name), attempt, err)
+
+		if err == nil || attempt >= policy.MaxAttempts || !policy.retryable(err) {
+			return next, err
+		}
+
+		select {
+		case <-time.After(policy.backoff(attempt)):
+		case <-ctx.Done():
+			return "", errors.Wrapf(ctx.Err(), "step %s stopped while waiting for retry", name)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package fsm_test
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/fsmtest"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+func TestRetryExhausted(t *testing.T) {
+	h := fsmtest.New(t)
+	errUnavailable := errors.New("unavailable")
+	var attempts int32
+
+	sm := fsm.NewStepMap()
+	sm.AddStepWithOptions("Call", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		atomic.AddInt32(&attempts, 1)
+		return "", errUnavailable
+	}, fsm.StepOptions{
+		Retry: &fsm.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+	})
+
+	if err := h.Executor.AddControlGraph("Retried", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Retried", nil).AssertStatus(storage.Failed)
+
+	if attempts := atomic.LoadInt32(&attempts); !errors.Is(job.Err, errUnavailable) || attempts != 3 {
+		t.Fatalf("job has failed with %v after %d attempts", job.Err, attempts)
+	}
+
+	recorded := job.Object().Attempts
+	if len(recorded) != 3 {
+		t.Fatalf("job has recorded attempts %v", recorded)
+	}
+
+	for i, attempt := range recorded {
+		if attempt.Step != "Call" || attempt.Attempt != i+1 || attempt.Error != errUnavailable.Error() {
+			t.Fatalf("attempt %d is recorded as %+v", i+1, attempt)
+		}
+	}
+}
+
+func TestRetrySucceeds(t *testing.T) {
+	h := fsmtest.New(t)
+	var attempts int32
+
+	sm := fsm.NewStepMap()
+	sm.AddStepWithOptions("Call", []fsm.NodeName{"Done"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			return "", errors.New("unavailable")
+		}
+
+		return "Done", nil
+	}, fsm.StepOptions{
+		Retry: &fsm.RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond, Jitter: 0.5},
+	})
+	sm.AddStep("Done", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Retried", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Run("Retried", nil).AssertStatus(storage.Completed).AssertPath("Call", "Done")
+
+	if attempts := atomic.LoadInt32(&attempts); attempts != 3 {
+		t.Fatalf("step was attempted %d times", attempts)
+	}
+}
+
+func TestNonRetryableError(t *testing.T) {
+	h := fsmtest.New(t)
+	errDeclined := errors.New("card declined")
+	var attempts int32
+
+	sm := fsm.NewStepMap()
+	sm.AddStepWithOptions("Charge", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		atomic.AddInt32(&attempts, 1)
+		return "", errDeclined
+	}, fsm.StepOptions{
+		Retry: &fsm.RetryPolicy{
+			MaxAttempts:    5,
+			InitialBackoff: time.Millisecond,
+			Retryable: func(err error) bool {
+				return !errors.Is(err, errDeclined)
+			},
+		},
+	})
+
+	if err := h.Executor.AddControlGraph("Payment", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Payment", nil).AssertStatus(storage.Failed)
+
+	if attempts := atomic.LoadInt32(&attempts); !errors.Is(job.Err, errDeclined) || attempts != 1 {
+		t.Fatalf("job has failed with %v after %d attempts", job.Err, attempts)
+	}
+}
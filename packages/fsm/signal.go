@@ -0,0 +1,59 @@
+package fsm
+
+import (
+	"github.com/pkg/errors"
+	"time"
+)
+
+// SignalWait describes external signal job waits for
+type SignalWait struct {
+	Name string
+	// Node job continues from when signal is delivered
+	Node NodeName
+	// Timeout is optional, job continues from TimeoutNode if signal wasn't delivered in time.
+	// TimeoutNode is required along with Timeout.
+	Timeout     time.Duration
+	TimeoutNode NodeName
+}
+
+// AwaitSignal parks job after the step until signal is delivered, signal payload is merged into job state.
+// Step should return its result.
+func (ec *ExecutionContext) AwaitSignal(wait SignalWait) NodeName {
+	ec.signal = &wait
+	return wait.Node
+}
+
+// awaitSignal parks job until signal is delivered or its timeout is over
+func (e *Executor) awaitSignal(wait *SignalWait, execCont *ExecutionContext) error {
+	if execCont.Branch != "" || execCont.child {
+		return errors.Errorf("job can't wait for signal %s inside of fan out branch or sub graph", wait.Name)
+	}
+
+	if wait.Timeout > 0 && wait.TimeoutNode == "" {
+		return errors.Errorf("signal %s has timeout without timeout node", wait.Name)
+	}
+
+	if wait.Timeout > 0 && e.scheduler == nil {
+		return errors.Errorf("job can't wait for signal %s with timeout without scheduler", wait.Name)
+	}
+
+	var deadline time.Time
+	if wait.Timeout > 0 {
+		deadline = e.clock().Add(wait.Timeout)
+	}
+
+	// job has to be parked before it's scheduled, otherwise it may be delivered in processing state
+	err := e.storage.AwaitSignal(execCont.JobId, wait.Name, string(wait.Node), string(wait.TimeoutNode), deadline)
+
+	if err != nil {
+		return errors.Wrapf(err, "couldn't park job until signal %s", wait.Name)
+	}
+
+	if wait.Timeout > 0 {
+		if err := e.scheduler.Schedule(execCont.JobId, execCont.priority, deadline); err != nil {
+			return errors.Wrapf(err, "couldn't schedule timeout of signal %s", wait.Name)
+		}
+	}
+
+	return errSuspended
+}
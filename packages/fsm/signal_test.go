@@ -0,0 +1,184 @@
+package fsm_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/fsmtest"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+func TestSignal(t *testing.T) {
+	h := fsmtest.New(t)
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Submit", []fsm.NodeName{"Reimburse", "Escalate"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return ec.AwaitSignal(fsm.SignalWait{
+			Name:        "approve",
+			Node:        "Reimburse",
+			Timeout:     time.Hour,
+			TimeoutNode: "Escalate",
+		}), nil
+	})
+	sm.AddStep("Reimburse", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		// signal payload is merged into job state
+		approver, _ := ec.GetState("approver")
+		ec.SetOutput(approver)
+		return "", nil
+	})
+	sm.AddStep("Escalate", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Expense", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Expense", nil).AssertStatus(storage.Waiting)
+
+	if obj := job.Object(); obj.AwaitedSignal != "approve" || !obj.WakeAt.Equal(h.Now().Add(time.Hour)) {
+		t.Fatalf("job waits for signal %q until %v", obj.AwaitedSignal, obj.WakeAt)
+	}
+
+	job.Signal("approve", map[string]interface{}{"approver": "alice"}).
+		AssertStatus(storage.Completed).
+		AssertPath("Submit", "Reimburse").
+		AssertOutput("alice")
+
+	if ok, err := h.Repository.DeliverSignal(job.ID, "approve", nil); ok || err != nil {
+		t.Fatalf("signal was delivered twice: %v", err)
+	}
+
+	// timeout of the delivered signal is ignored
+	job.Advance(time.Hour).AssertStatus(storage.Completed).AssertPath("Submit", "Reimburse")
+}
+
+func TestSignalTimeout(t *testing.T) {
+	h := fsmtest.New(t)
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Dispatch", []fsm.NodeName{"Close", "Investigate"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return ec.AwaitSignal(fsm.SignalWait{
+			Name:        "delivered",
+			Node:        "Close",
+			Timeout:     time.Hour * 72,
+			TimeoutNode: "Investigate",
+		}), nil
+	})
+	sm.AddStep("Close", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+	sm.AddStep("Investigate", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Parcel", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Parcel", nil).AssertStatus(storage.Waiting)
+
+	job.Advance(time.Hour * 71).AssertStatus(storage.Waiting)
+	job.Advance(time.Hour).AssertStatus(storage.Completed).AssertPath("Dispatch", "Investigate")
+
+	if ok, err := h.Repository.DeliverSignal(job.ID, "delivered", nil); ok || err != nil {
+		t.Fatalf("signal was delivered after timeout: %v", err)
+	}
+}
+
+func TestSignalWithoutTimeout(t *testing.T) {
+	h := fsmtest.New(t)
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Register", []fsm.NodeName{"Welcome"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return ec.AwaitSignal(fsm.SignalWait{Name: "confirmed", Node: "Welcome"}), nil
+	})
+	sm.AddStep("Welcome", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Account", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Account", nil).AssertStatus(storage.Waiting)
+
+	// job without timeout is delivered only by its signal
+	if err := h.Executor.RunJob(job.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	job.Advance(time.Hour * 24 * 365).AssertStatus(storage.Waiting)
+	job.Signal("confirmed", nil).AssertStatus(storage.Completed).AssertPath("Register", "Welcome")
+}
+
+func TestSignalTimeoutWithoutNode(t *testing.T) {
+	h := fsmtest.New(t)
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Quote", []fsm.NodeName{"Accept"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return ec.AwaitSignal(fsm.SignalWait{Name: "accepted", Node: "Accept", Timeout: time.Hour}), nil
+	})
+	sm.AddStep("Accept", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Quote", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Run("Quote", nil).AssertStatus(storage.Failed)
+}
+
+func TestSignalStrictTimeoutNode(t *testing.T) {
+	h := fsmtest.New(t)
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Quote", []fsm.NodeName{"Accept"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return ec.AwaitSignal(fsm.SignalWait{Name: "accepted", Node: "Accept", Timeout: time.Hour, TimeoutNode: "Expire"}), nil
+	})
+	sm.AddStep("Accept", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraphWithOptions("Quote", sm, fsm.GraphOptions{StrictTransitions: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Quote", nil).AssertStatus(storage.Failed)
+
+	if !errors.Is(job.Err, fsm.ErrInvalidTransition) {
+		t.Fatalf("job has failed with %v, expected %v", job.Err, fsm.ErrInvalidTransition)
+	}
+}
+
+func TestSignalInvalidPayload(t *testing.T) {
+	h := fsmtest.New(t)
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Upload", []fsm.NodeName{"Verify"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return ec.AwaitSignal(fsm.SignalWait{Name: "scanned", Node: "Verify"}), nil
+	})
+	sm.AddStep("Verify", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Document", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Document", nil).AssertStatus(storage.Waiting)
+
+	// payload is merged into job state, so its keys can't be mongodb paths or operators
+	for _, key := range []string{"", "user.name", "$set"} {
+		_, err := h.Repository.DeliverSignal(job.ID, "scanned", map[string]interface{}{key: 1})
+
+		if !errors.Is(err, storage.ErrInvalidPayload) {
+			t.Errorf("payload key %q was delivered with %v", key, err)
+		}
+	}
+
+	job.AssertStatus(storage.Waiting)
+}
@@ -0,0 +1,309 @@
+package fsm
+
+import (
+	"context"
+	"fmt"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+// StepStub replaces step during simulation, it returns scripted node or fails with scripted error
+type StepStub struct {
+	Next  NodeName `json:"next"`
+	Error string   `json:"error"`
+}
+
+// SimulationOptions describe simulated job. Every step is replaced with its stub, or with function from Steps,
+// or with its StepOptions.DryRun version, in that order. Steps which have none of them fail the simulation
+// unless RunSteps is set. Stubs and Steps apply to nodes of sub graphs as well. Interceptors have side effects
+// too, so only RecoverPanic wraps simulated steps unless RunSteps is set. RunSteps can't be set from request body.
+type SimulationOptions struct {
+	Version    string                    `json:"version"`
+	EntryPoint NodeName                  `json:"entryPoint"`
+	Params     map[string]interface{}    `json:"params"`
+	Stubs      map[NodeName]StepStub     `json:"stubs"`
+	Steps      map[NodeName]StepFunction `json:"-"`
+	RunSteps   bool                      `json:"-"`
+}
+
+// SimulatedStep is single step taken by simulated job or by its child job
+type SimulatedStep struct {
+	JobId    string        `json:"jobId"`
+	Node     NodeName      `json:"node"`
+	Next     NodeName      `json:"next"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// SimulationResult describes the path simulated job took, compensations are listed in order of execution
+type SimulationResult struct {
+	Graph         string                 `json:"graph"`
+	Version       string                 `json:"version"`
+	Status        storage.Status         `json:"status"`
+	Error         string                 `json:"error,omitempty"`
+	Path          []SimulatedStep        `json:"path"`
+	Compensations []NodeName             `json:"compensations"`
+	State         map[string]interface{} `json:"state"`
+	Output        interface{}            `json:"output"`
+	Duration      time.Duration          `json:"duration"`
+}
+
+// GraphSimulator runs registered graphs without side effects
+type GraphSimulator interface {
+	Simulate(name string, options SimulationOptions) (*SimulationResult, error)
+}
+
+// Simulate runs registered graph with stubbed steps. Nothing is written to executor's storage, observers
+// aren't notified, compensations are only recorded and job doesn't wait for timers or signals.
+func (e *Executor) Simulate(name string, options SimulationOptions) (*SimulationResult, error) {
+	graph, ok := e.executionStore.loadGraph(name, options.Version)
+
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownGraph, "graph %s of version %q", name, options.Version)
+	}
+
+	recorder := &simulationRecorder{}
+	simStorage := &simulationStorage{}
+	sim := NewExecutor(storage.NewRepository(simStorage), e.executionDependencies, 1)
+	sim.interceptors = []Interceptor{RecoverPanic}
+	if options.RunSteps {
+		sim.interceptors = e.interceptors
+	}
+	sim.strictTransitions = e.strictTransitions
+	sim.observers = observers{recorder}
+	sim.simulated = true
+
+	e.executionStore.mux.RLock()
+	for graphName, versions := range e.executionStore.store {
+		simVersions := make(map[string]storeEntry, len(versions))
+
+		for version, entry := range versions {
+			entry.stepMap = simulatedStepMap(entry.stepMap, options, recorder)
+			if !options.RunSteps {
+				entry.options.Interceptors = nil
+			}
+			simVersions[version] = entry
+		}
+
+		sim.executionStore.store[graphName] = simVersions
+		sim.executionStore.latest[graphName] = e.executionStore.latest[graphName]
+	}
+	e.executionStore.mux.RUnlock()
+
+	graph, _ = sim.executionStore.loadGraph(name, graph.version)
+
+	params := options.Params
+	if params == nil {
+		params = make(map[string]interface{})
+	}
+
+	job, err := sim.storage.CreateJob(storage.ObjectDTO{
+		Status:       storage.Initial,
+		CommandGraph: name,
+		GraphVersion: graph.version,
+		EntryPoint:   string(options.EntryPoint),
+		Params:       params,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	started := time.Now()
+	execCont, err := sim.runJob(context.Background(), job, graph)
+
+	if execCont == nil {
+		return nil, err
+	}
+
+	result := &SimulationResult{
+		Graph:         name,
+		Version:       graph.version,
+		Status:        simStorage.status(job.ID.(string)),
+		Path:          recorder.path,
+		Compensations: recorder.compensations,
+		Duration:      time.Since(started),
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	execCont.shared.mux.RLock()
+	result.State = execCont.shared.values
+	result.Output = execCont.shared.output
+	execCont.shared.mux.RUnlock()
+
+	return result, nil
+}
+
+// simulatedStepMap copies step map with steps and compensations replaced for simulation
+func simulatedStepMap(sm stepMap, options SimulationOptions, recorder *simulationRecorder) stepMap {
+	simulated := make(stepMap, len(sm))
+
+	for name, node := range sm {
+		name := name
+
+		if node.function != nil {
+			node.function = simulatedStep(name, node, options)
+		}
+
+		if node.options.Compensation != nil {
+			node.options.Compensation = func(_ *ExecutionContext) (NodeName, error) {
+				recorder.compensate(name)
+				return "", nil
+			}
+		}
+
+		simulated[name] = node
+	}
+
+	return simulated
+}
+
+func simulatedStep(name NodeName, node nodeMap, options SimulationOptions) StepFunction {
+	if stub, ok := options.Stubs[name]; ok {
+		return func(_ *ExecutionContext) (NodeName, error) {
+			if stub.Error != "" {
+				return "", errors.New(stub.Error)
+			}
+
+			return stub.Next, nil
+		}
+	}
+
+	if step, ok := options.Steps[name]; ok {
+		return step
+	}
+
+	if node.options.DryRun != nil {
+		return node.options.DryRun
+	}
+
+	if options.RunSteps {
+		return node.function
+	}
+
+	return func(_ *ExecutionContext) (NodeName, error) {
+		return "", errors.Errorf("step %s has neither stub nor dry run version", name)
+	}
+}
+
+// simulationRecorder collects steps of simulated job and its child jobs
+type simulationRecorder struct {
+	NopObserver
+	mux           sync.Mutex
+	path          []SimulatedStep
+	compensations []NodeName
+}
+
+func (sr *simulationRecorder) StepFinished(jobId string, node NodeName, next NodeName, err error, duration time.Duration) {
+	step := SimulatedStep{
+		JobId:    jobId,
+		Node:     node,
+		Next:     next,
+		Duration: duration,
+	}
+
+	if err != nil {
+		step.Error = err.Error()
+	}
+
+	sr.mux.Lock()
+	sr.path = append(sr.path, step)
+	sr.mux.Unlock()
+}
+
+func (sr *simulationRecorder) compensate(node NodeName) {
+	sr.mux.Lock()
+	sr.compensations = append(sr.compensations, node)
+	sr.mux.Unlock()
+}
+
+// simulationStorage keeps only plain fields of simulated jobs, which is enough for conditional updates.
+// Simulated jobs are never read back.
+type simulationStorage struct {
+	mux  sync.Mutex
+	jobs map[string]storage.KV
+	n    int
+}
+
+func (ss *simulationStorage) Create(obj storage.ObjectDTO) (*storage.Object, error) {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+
+	if ss.jobs == nil {
+		ss.jobs = make(map[string]storage.KV)
+	}
+
+	ss.n++
+	id := fmt.Sprintf("simulation-%d", ss.n)
+	ss.jobs[id] = storage.KV{
+		"status": obj.Status,
+	}
+
+	return &storage.Object{
+		ID:           id,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+		Status:       obj.Status,
+		Priority:     obj.Priority,
+		CommandGraph: obj.CommandGraph,
+		GraphVersion: obj.GraphVersion,
+		EntryPoint:   obj.EntryPoint,
+		Params:       obj.Params,
+		ParentId:     obj.ParentId,
+		ParentStep:   obj.ParentStep,
+	}, nil
+}
+
+func (ss *simulationStorage) CreateIdempotent(obj storage.ObjectDTO) (*storage.Object, bool, error) {
+	job, err := ss.Create(obj)
+	return job, err == nil, err
+}
+
+func (ss *simulationStorage) FindById(id string) (*storage.Object, error) {
+	return nil, errors.Errorf("simulated job %s can't be read back", id)
+}
+
+func (ss *simulationStorage) Find(_ storage.KV) ([]*storage.Object, error) {
+	return nil, nil
+}
+
+func (ss *simulationStorage) UpdateById(id string, update storage.KV, _ storage.OperationMap) error {
+	_, err := ss.UpdateByIdIf(id, nil, update, nil)
+	return err
+}
+
+func (ss *simulationStorage) UpdateByIdIf(id string, condition storage.KV, update storage.KV, _ storage.OperationMap) (bool, error) {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+
+	job, ok := ss.jobs[id]
+
+	if !ok {
+		return false, errors.Errorf("simulated job %s doesn't exist", id)
+	}
+
+	for key, val := range condition {
+		if job[key] != val {
+			return false, nil
+		}
+	}
+
+	for key, val := range update {
+		job[key] = val
+	}
+
+	return true, nil
+}
+
+func (ss *simulationStorage) status(id string) storage.Status {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+
+	status, _ := ss.jobs[id]["status"].(storage.Status)
+	return status
+}
@@ -0,0 +1,153 @@
+package fsm_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/fsmtest"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+func TestSimulate(t *testing.T) {
+	h := fsmtest.New(t)
+
+	// real steps fail the test, simulation runs stubs, dry runs and given functions only
+	real := func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		t.Error("real step was executed in simulation")
+		return "", nil
+	}
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Reserve", []fsm.NodeName{"Charge"}, real)
+	sm.AddStepWithOptions("Charge", []fsm.NodeName{"Notify"}, real, fsm.StepOptions{
+		DryRun: func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+			ec.SetOutput("charged")
+			return ec.ContinueAfter("Notify", time.Hour), nil
+		},
+	})
+	sm.AddStep("Notify", nil, real)
+
+	if err := h.Executor.AddControlGraph("Payment", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := h.Executor.Simulate("Payment", fsm.SimulationOptions{
+		Stubs: map[fsm.NodeName]fsm.StepStub{"Reserve": {Next: "Charge"}},
+		Steps: map[fsm.NodeName]fsm.StepFunction{
+			"Notify": func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+				return "", nil
+			},
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Status != storage.Completed || len(result.Path) != 3 || result.Output != "charged" {
+		t.Fatalf("simulation has finished with %+v", result)
+	}
+
+	if jobs, _ := h.Repository.FindByStatus(storage.Completed); len(jobs) != 0 {
+		t.Fatalf("simulation has written %d jobs into storage", len(jobs))
+	}
+
+	if _, err := h.Executor.Simulate("Unknown", fsm.SimulationOptions{}); !errors.Is(err, fsm.ErrUnknownGraph) {
+		t.Fatalf("unknown graph was simulated with %v", err)
+	}
+}
+
+func TestSimulateFailure(t *testing.T) {
+	h := fsmtest.New(t)
+
+	real := func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		t.Error("real step was executed in simulation")
+		return "", nil
+	}
+
+	sm := fsm.NewStepMap()
+	sm.AddStepWithOptions("Reserve", []fsm.NodeName{"Charge"}, real, fsm.StepOptions{Compensation: real})
+	sm.AddStep("Charge", []fsm.NodeName{"Notify"}, real)
+	sm.AddStep("Notify", nil, real)
+
+	if err := h.Executor.AddControlGraph("Payment", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := h.Executor.Simulate("Payment", fsm.SimulationOptions{
+		Stubs: map[fsm.NodeName]fsm.StepStub{
+			"Reserve": {Next: "Charge"},
+			"Charge":  {Error: "bank is down"},
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// compensation is recorded, but real compensation isn't executed
+	if result.Status != storage.Compensated || result.Error == "" {
+		t.Fatalf("simulation has finished with %+v", result)
+	}
+
+	if len(result.Compensations) != 1 || result.Compensations[0] != "Reserve" {
+		t.Fatalf("simulation has compensated %v", result.Compensations)
+	}
+
+	// step without stub, function or dry run fails simulation
+	result, _ = h.Executor.Simulate("Payment", fsm.SimulationOptions{
+		Stubs: map[fsm.NodeName]fsm.StepStub{"Reserve": {Next: "Charge"}, "Charge": {Next: "Notify"}},
+	})
+
+	if result.Status != storage.Compensated || len(result.Path) != 3 || result.Path[2].Error == "" {
+		t.Fatalf("simulation has finished with %+v", result)
+	}
+}
+
+func TestSimulateSkipsInterceptors(t *testing.T) {
+	h := fsmtest.New(t)
+	intercepted := 0
+
+	h.Executor.Use(func(node fsm.NodeName, ec *fsm.ExecutionContext, next fsm.StepHandler) (fsm.NodeName, error) {
+		intercepted++
+		return next(node, ec)
+	})
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Explode", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Explosive", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	var options fsm.SimulationOptions
+
+	if err := json.Unmarshal([]byte(`{"runSteps": true}`), &options); err != nil || options.RunSteps {
+		t.Fatalf("real steps were enabled from request body: %v", err)
+	}
+
+	// panic is still recovered, even though the rest of interceptors is skipped
+	options.Steps = map[fsm.NodeName]fsm.StepFunction{
+		"Explode": func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+			panic("boom")
+		},
+	}
+
+	result, err := h.Executor.Simulate("Explosive", options)
+
+	if err != nil || result.Status != storage.Failed || intercepted != 0 {
+		t.Fatalf("simulation has finished with %+v, %v after %d interceptions", result, err, intercepted)
+	}
+
+	options.Steps = nil
+	options.RunSteps = true
+
+	if _, err := h.Executor.Simulate("Explosive", options); err != nil || intercepted != 1 {
+		t.Fatalf("real step wasn't intercepted: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package fsm
+
+import (
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+	"log"
+	"sync"
+)
+
+// jobState holds data which is shared between all branches of the job and persisted after each step
+type jobState struct {
+	mux     sync.RWMutex
+	values  map[string]interface{}
+	output  interface{}
+	changed bool
+	// completed steps which have to be compensated on failure, in order of completion
+	completed []NodeName
+	// child jobs which were created before the job was resumed, keyed by their parent step
+	children map[NodeName]string
+}
+
+func newJobState(job *storage.Object) *jobState {
+	values := job.State
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+
+	completed := make([]NodeName, 0, len(job.CompletedSteps))
+	for _, step := range job.CompletedSteps {
+		completed = append(completed, NodeName(step))
+	}
+
+	return &jobState{
+		values:    values,
+		output:    job.Output,
+		completed: completed,
+	}
+}
+
+// snapshot returns copy of the state if it was changed since the last snapshot
+func (js *jobState) snapshot() (values map[string]interface{}, output interface{}, changed bool) {
+	js.mux.Lock()
+	defer js.mux.Unlock()
+
+	if !js.changed {
+		return nil, nil, false
+	}
+
+	values = make(map[string]interface{}, len(js.values))
+	for key, val := range js.values {
+		values[key] = val
+	}
+
+	js.changed = false
+
+	return values, js.output, true
+}
+
+// GetState reads value written by previous steps of the job.
+// Values of resumed jobs are read back from storage, so complex values are represented with storage types.
+func (ec *ExecutionContext) GetState(key string) (val interface{}, ok bool) {
+	ec.shared.mux.RLock()
+	defer ec.shared.mux.RUnlock()
+
+	val, ok = ec.shared.values[key]
+	return
+}
+
+// SetState writes value which is available to the following steps and persisted along with the job
+func (ec *ExecutionContext) SetState(key string, val interface{}) {
+	ec.shared.mux.Lock()
+	defer ec.shared.mux.Unlock()
+
+	ec.shared.values[key] = val
+	ec.shared.changed = true
+}
+
+// SetOutput sets result of the whole job, last written value is kept
+func (ec *ExecutionContext) SetOutput(val interface{}) {
+	ec.shared.mux.Lock()
+	defer ec.shared.mux.Unlock()
+
+	ec.shared.output = val
+	ec.shared.changed = true
+}
+
+func (e *Executor) saveState(execCont *ExecutionContext) {
+	values, output, changed := execCont.shared.snapshot()
+
+	if !changed {
+		return
+	}
+
+	// inability to save state shouldn't cripple graph execution
+	if err := e.storage.SaveState(execCont.JobId, values, output); err != nil {
+		log.Printf("Couldn't save state of job %s: %v", execCont.JobId, err)
+	}
+}
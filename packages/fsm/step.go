@@ -0,0 +1,83 @@
+package fsm
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// StepOptions describe how single node of control graph is executed
+type StepOptions struct {
+	// Timeout limits single step execution, zero means no limit
+	Timeout time.Duration
+	// Retry describes how step is retried on error, nil means no retries
+	Retry *RetryPolicy
+	// Resume tells whether step may be re-run when job is recovered after crash
+	Resume ResumePolicy
+	// Compensation undoes side effects of successfully completed step when job fails later on,
+	// its returned node is ignored
+	Compensation StepFunction
+	// ErrorEdges route step error to handler nodes instead of failing the job, first matching edge wins
+	ErrorEdges []ErrorEdge
+	// DryRun replaces the step in simulation, it must not have side effects
+	DryRun StepFunction
+	// MaxConcurrency limits number of jobs executing the step at once, zero means no limit.
+	// Jobs over the limit wait in line holding their executor.
+	MaxConcurrency int
+}
+
+type stepResult struct {
+	next NodeName
+	err  error
+}
+
+// jobContext creates context for job execution, limited by job deadline if any.
+// Remaining time is measured on executor clock, so parking on fake clock counts as well.
+func jobContext(parent context.Context, deadline time.Time, now time.Time) (context.Context, context.CancelFunc) {
+	if !deadline.IsZero() {
+		return context.WithTimeout(parent, deadline.Sub(now))
+	}
+
+	return context.WithCancel(parent)
+}
+
+// runStep invokes step handler in separate goroutine, so hung step
+// won't hold consumer after its context is done. Every attempt gets its own copy of execution context,
+// so attempt which is left running can't affect the following ones. Parking request and context
+// are taken only from attempt which has returned.
+func runStep(ctx context.Context, name NodeName, timeout time.Duration, handler StepHandler, execCont *ExecutionContext) (NodeName, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	attempt := *execCont
+	attempt.Context = ctx
+	attempt.wakeAt = time.Time{}
+	attempt.signal = nil
+	done := make(chan stepResult, 1)
+
+	go func() {
+		next, err := handler(name, &attempt)
+		done <- stepResult{next: next, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		execCont.Context = attempt.Context
+		execCont.wakeAt = attempt.wakeAt
+		execCont.signal = attempt.signal
+		return res.next, res.err
+	case <-ctx.Done():
+		if isTimeout(ctx.Err()) {
+			return "", errors.Wrapf(ctx.Err(), "step %s didn't finish in time", name)
+		}
+
+		return "", errors.Wrapf(ctx.Err(), "step %s was cancelled", name)
+	}
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,105 @@
+package fsm_test
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/fsmtest"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+func TestStepTimeout(t *testing.T) {
+	h := fsmtest.New(t)
+	release := make(chan struct{})
+	defer close(release)
+
+	sm := fsm.NewStepMap()
+	sm.AddStepWithOptions("Hang", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		<-release
+		return "", nil
+	}, fsm.StepOptions{Timeout: time.Millisecond * 10})
+
+	if err := h.Executor.AddControlGraph("Hanging", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Hanging", nil).AssertStatus(storage.TimedOut)
+
+	if job.Err == nil || !strings.Contains(job.Err.Error(), "didn't finish in time") {
+		t.Fatalf("job has failed with %v", job.Err)
+	}
+}
+
+func TestRetryAfterTimeout(t *testing.T) {
+	h := fsmtest.New(t)
+	abandoned := make(chan struct{})
+	var attempts int32
+
+	sm := fsm.NewStepMap()
+	sm.AddStepWithOptions("Call", []fsm.NodeName{"Later", "Done"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			<-ec.Context.Done()
+
+			// abandoned attempt asks to park the job before the next attempt returns
+			next := ec.ContinueAfter("Later", time.Hour)
+			close(abandoned)
+			return next, nil
+		}
+
+		<-abandoned
+		return "Done", nil
+	}, fsm.StepOptions{
+		Timeout: time.Millisecond * 50,
+		Retry:   &fsm.RetryPolicy{MaxAttempts: 2},
+	})
+	sm.AddStep("Later", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+	sm.AddStep("Done", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Retried", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Run("Retried", nil).AssertStatus(storage.Completed).AssertPath("Call", "Done")
+
+	if attempts := atomic.LoadInt32(&attempts); attempts != 2 {
+		t.Fatalf("step was attempted %d times", attempts)
+	}
+}
+
+func TestJobDeadlineKeptWhileWaiting(t *testing.T) {
+	h := fsmtest.New(t)
+	var woken int32
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Remind", []fsm.NodeName{"Expire"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return ec.ContinueAfter("Expire", time.Hour), nil
+	})
+	sm.AddStep("Expire", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		atomic.AddInt32(&woken, 1)
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraphWithOptions("Reminder", sm, fsm.GraphOptions{Timeout: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Reminder", nil).AssertStatus(storage.Waiting)
+
+	if deadline := job.Object().Deadline; !deadline.Equal(h.Now().Add(time.Minute)) {
+		t.Fatalf("job deadline is %v", deadline)
+	}
+
+	// job has spent its whole minute waiting, so it's out of time once it wakes up
+	job.Advance(time.Hour).AssertStatus(storage.TimedOut)
+
+	if woken := atomic.LoadInt32(&woken); woken != 0 {
+		t.Fatalf("step was executed %d times after deadline", woken)
+	}
+}
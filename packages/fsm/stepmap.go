@@ -8,8 +8,13 @@ func NewStepMap() stepMap {
 }
 
 func (sm stepMap) AddStep(node NodeName, childrenNodes []NodeName, nodeFunction StepFunction) {
+	sm.AddStepWithOptions(node, childrenNodes, nodeFunction, StepOptions{})
+}
+
+func (sm stepMap) AddStepWithOptions(node NodeName, childrenNodes []NodeName, nodeFunction StepFunction, options StepOptions) {
 	sm[node] = nodeMap{
 		children: NewNodeSet(childrenNodes...),
 		function: nodeFunction,
+		options:  options,
 	}
 }
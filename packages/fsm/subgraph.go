@@ -0,0 +1,264 @@
+package fsm
+
+import (
+	"context"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+	"github.com/pkg/errors"
+	"log"
+	"time"
+)
+
+// SubGraph describes node which executes another registered graph as a child job
+type SubGraph struct {
+	// Graph is the name of registered graph
+	Graph string
+	// Version of the graph, empty value means the latest one at the moment of invocation
+	Version string
+	// EntryPoint of the graph, empty value means its root
+	EntryPoint NodeName
+	// OnComplete is the node parent job proceeds to when child job completes
+	OnComplete NodeName
+	// OnFailure is the node parent job proceeds to when child job fails,
+	// child error is available there as ExecutionContext.Error. Empty value fails parent job.
+	OnFailure NodeName
+	// OutputKey is the parent job state key child job output is written to, empty value discards output
+	OutputKey string
+}
+
+// AddSubGraph adds node which executes another graph as a child job with its own storage object.
+// Child job receives copy of parent job params.
+func (sm stepMap) AddSubGraph(node NodeName, subGraph SubGraph) {
+	children := NewNodeSet(subGraph.OnComplete)
+	if subGraph.OnFailure != "" {
+		children.Set(subGraph.OnFailure)
+	}
+
+	sm[node] = nodeMap{
+		children: children,
+		subGraph: &subGraph,
+	}
+}
+
+// checkSubGraphs makes sure that graph doesn't invoke itself through sub graphs. Registered graphs
+// are already checked, so any new cycle has to go through the given one. Graphs which aren't
+// registered yet are checked on their own registration.
+func (e *Executor) checkSubGraphs(name string, version string, sm stepMap) error {
+	visited := make(map[string]bool)
+
+	var visit func(sm stepMap) error
+	visit = func(sm stepMap) error {
+		for _, node := range sm {
+			if node.subGraph == nil {
+				continue
+			}
+
+			child := node.subGraph
+			// given graph becomes the latest version of its name after registration
+			if child.Graph == name && (child.Version == "" || child.Version == version) {
+				return errors.Errorf("graph %s invokes itself via sub graphs", name)
+			}
+
+			key := child.Graph + "@" + child.Version
+			if visited[key] {
+				continue
+			}
+			visited[key] = true
+
+			entry, ok := e.executionStore.loadGraph(child.Graph, child.Version)
+			if !ok {
+				continue
+			}
+
+			if err := visit(entry.stepMap); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return visit(sm)
+}
+
+// resumableChildren finds child jobs which were created by the step job was stopped at.
+// They are created after the last checkin of the job, so earlier visits of the same steps are ignored.
+func (e *Executor) resumableChildren(job *storage.Object) map[NodeName]string {
+	var since time.Time
+
+	for _, checkin := range job.Checkins {
+		if checkin.Branch == "" {
+			since = checkin.Timestamp
+		}
+	}
+
+	children := make(map[NodeName]string)
+
+	for i := len(job.Children) - 1; i >= 0; i-- {
+		child, err := e.storage.FindById(job.Children[i])
+
+		if err != nil {
+			log.Printf("Couldn't find child job %s of job %s: %v", job.Children[i], job.ID, err)
+			continue
+		}
+
+		if child.CreatedAt.Before(since) {
+			break
+		}
+
+		// the latest child of the step wins
+		node := NodeName(child.ParentStep)
+		if _, ok := children[node]; !ok && node != "" {
+			children[node] = job.Children[i]
+		}
+	}
+
+	return children
+}
+
+// takeChild returns child job which was created by the step before job was resumed, child is taken only once
+func (js *jobState) takeChild(node NodeName) (string, bool) {
+	js.mux.Lock()
+	defer js.mux.Unlock()
+
+	childId, ok := js.children[node]
+	delete(js.children, node)
+
+	return childId, ok
+}
+
+// childJob returns child job the step has to wait for. Child which was created by the step before job
+// was resumed is reused, otherwise new child is created.
+func (e *Executor) childJob(node NodeName, subGraph *SubGraph, execCont *ExecutionContext) (*storage.Object, storeEntry, error) {
+	if childId, ok := execCont.shared.takeChild(node); ok {
+		child, err := e.storage.FindById(childId)
+
+		if err != nil {
+			return nil, storeEntry{}, errors.Wrapf(err, "couldn't find child job %s of step %s", childId, node)
+		}
+
+		graph, ok := e.executionStore.loadGraph(child.CommandGraph, child.GraphVersion)
+
+		if !ok {
+			return nil, storeEntry{}, errors.Errorf("graph %s of version %q of child job %s wasn't loaded", child.CommandGraph, child.GraphVersion, childId)
+		}
+
+		log.Printf("Job %s resumes its child job %s of step %s", execCont.JobId, childId, node)
+
+		return child, graph, nil
+	}
+
+	graph, ok := e.executionStore.loadGraph(subGraph.Graph, subGraph.Version)
+
+	if !ok {
+		return nil, storeEntry{}, errors.Errorf("sub graph %s of version %q of step %s wasn't loaded", subGraph.Graph, subGraph.Version, node)
+	}
+
+	execCont.shared.mux.RLock()
+	params := make(map[string]interface{}, len(execCont.Params))
+	for key, val := range execCont.Params {
+		params[key] = val
+	}
+	execCont.shared.mux.RUnlock()
+
+	child, err := e.storage.CreateJob(storage.ObjectDTO{
+		Status:       storage.Initial,
+		Priority:     execCont.priority,
+		CommandGraph: subGraph.Graph,
+		GraphVersion: graph.version,
+		EntryPoint:   string(subGraph.EntryPoint),
+		Params:       params,
+		ParentId:     execCont.JobId,
+		ParentStep:   string(node),
+	})
+
+	if err != nil {
+		return nil, storeEntry{}, errors.Wrapf(err, "couldn't create child job for step %s", node)
+	}
+
+	childId := child.ID.(string)
+
+	// inability to link child shouldn't cripple graph execution, child is still linked to parent
+	if err := e.storage.AddChild(execCont.JobId, childId); err != nil {
+		log.Printf("Couldn't link child job %s to job %s: %v", childId, execCont.JobId, err)
+	}
+
+	return child, graph, nil
+}
+
+// runChild executes child job and returns its output. Child which was finished before its parent
+// was resumed isn't executed again, the one which was stopped by crash is resumed from its checkpoint.
+func (e *Executor) runChild(ctx context.Context, child *storage.Object, graph storeEntry) (interface{}, error) {
+	id := child.ID.(string)
+
+	switch child.Status {
+	case storage.Initial, storage.Queued:
+	case storage.Completed:
+		return child.Output, nil
+	case storage.Processing:
+		if step, manual := interruptedStep(child, graph.stepMap); manual {
+			err := errors.Wrapf(errInterrupted, "step %s of child job %s requires operator decision", step, id)
+			if interruptErr := e.storage.InterruptJob(id, err); interruptErr != nil {
+				log.Printf("Couldn't interrupt job %s: %v", id, interruptErr)
+			}
+			return nil, err
+		}
+
+		fallthrough
+	case storage.Interrupted:
+		ok, err := e.storage.QueueJob(id, child.Status)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			return nil, errors.Errorf("child job %s has changed its status concurrently", id)
+		}
+
+		child.Status = storage.Queued
+	default:
+		return child.Output, errors.Errorf("child job %s is %s: %s", id, child.Status, child.Error)
+	}
+
+	childCont, err := e.runJob(ctx, child, graph)
+
+	if childCont == nil {
+		return nil, err
+	}
+
+	childCont.shared.mux.RLock()
+	output := childCont.shared.output
+	childCont.shared.mux.RUnlock()
+
+	return output, err
+}
+
+func (e *Executor) executeSubGraph(ctx context.Context, node NodeName, subGraph *SubGraph, execCont *ExecutionContext) (NodeName, error) {
+	child, graph, err := e.childJob(node, subGraph, execCont)
+
+	if err != nil {
+		return "", err
+	}
+
+	childId := child.ID.(string)
+	output, err := e.runChild(ctx, child, graph)
+
+	if subGraph.OutputKey != "" {
+		execCont.SetState(subGraph.OutputKey, output)
+	}
+
+	if err == nil {
+		return subGraph.OnComplete, nil
+	}
+
+	err = errors.Wrapf(err, "child job %s of step %s failed", childId, node)
+
+	// dead job context and interrupted child can't be handled by the graph
+	if subGraph.OnFailure == "" || ctx.Err() != nil || errors.Is(err, errInterrupted) {
+		return "", err
+	}
+
+	execCont.Error = err
+
+	return subGraph.OnFailure, nil
+}
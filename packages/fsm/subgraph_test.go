@@ -0,0 +1,213 @@
+package fsm_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/fsmtest"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+func TestSubGraph(t *testing.T) {
+	h := fsmtest.New(t)
+
+	quote := fsm.NewStepMap()
+	quote.AddStep("Price", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		// child job receives copy of parent params
+		items, _ := ec.GetParam("items")
+		ec.SetOutput(items.(int) * 10)
+		return "", nil
+	})
+
+	checkout := fsm.NewStepMap()
+	checkout.AddSubGraph("Quote", fsm.SubGraph{Graph: "Quote", OnComplete: "Charge", OutputKey: "total"})
+	checkout.AddStep("Charge", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		total, _ := ec.GetState("total")
+		ec.SetOutput(total)
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Quote", quote); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Executor.AddControlGraph("Checkout", checkout); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Checkout", map[string]interface{}{"items": 3}).
+		AssertStatus(storage.Completed).
+		AssertPath("Quote", "Charge").
+		AssertOutput(30)
+
+	children := job.Object().Children
+
+	if len(children) != 1 {
+		t.Fatalf("job has children %v", children)
+	}
+
+	child, err := h.Repository.FindById(children[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if child.Status != storage.Completed || child.ParentId != job.ID || child.ParentStep != "Quote" {
+		t.Fatalf("child job has %s status, parent %s and parent step %s", child.Status, child.ParentId, child.ParentStep)
+	}
+}
+
+func TestSubGraphFailure(t *testing.T) {
+	h := fsmtest.New(t)
+	errNoStock := errors.New("no stock")
+
+	reserve := fsm.NewStepMap()
+	reserve.AddStep("Reserve", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", errNoStock
+	})
+
+	handled := fsm.NewStepMap()
+	handled.AddSubGraph("Reserve", fsm.SubGraph{Graph: "Reserve", OnComplete: "Ship", OnFailure: "Backorder"})
+	handled.AddStep("Ship", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+	handled.AddStep("Backorder", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		ec.SetOutput(errors.Is(ec.Error, errNoStock))
+		return "", nil
+	})
+
+	unhandled := fsm.NewStepMap()
+	unhandled.AddSubGraph("Reserve", fsm.SubGraph{Graph: "Reserve", OnComplete: "Ship"})
+	unhandled.AddStep("Ship", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Reserve", reserve); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Executor.AddControlGraph("Order", handled); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Executor.AddControlGraph("Preorder", unhandled); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Run("Order", nil).AssertStatus(storage.Completed).AssertPath("Reserve", "Backorder").AssertOutput(true)
+
+	job := h.Run("Preorder", nil).AssertStatus(storage.Failed).AssertPath("Reserve")
+
+	if !errors.Is(job.Err, errNoStock) {
+		t.Fatalf("job has failed with %v, expected %v", job.Err, errNoStock)
+	}
+}
+
+func TestSubGraphCycle(t *testing.T) {
+	h := fsmtest.New(t)
+
+	invoice := fsm.NewStepMap()
+	invoice.AddSubGraph("Pay", fsm.SubGraph{Graph: "Payment", OnComplete: "Done"})
+
+	payment := fsm.NewStepMap()
+	payment.AddSubGraph("Bill", fsm.SubGraph{Graph: "Invoice", OnComplete: "Done"})
+
+	// payment isn't registered yet, so invoice can't be checked against it
+	if err := h.Executor.AddControlGraph("Invoice", invoice); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Executor.AddControlGraph("Payment", payment); err == nil {
+		t.Fatal("graphs which invoke each other were registered")
+	}
+}
+
+func TestRecoverParentReusesChild(t *testing.T) {
+	h := fsmtest.New(t)
+	runs := make(map[fsm.NodeName]int)
+
+	count := func(name fsm.NodeName, next fsm.NodeName) fsm.StepFunction {
+		return func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+			runs[name]++
+			return next, nil
+		}
+	}
+
+	label := fsm.NewStepMap()
+	label.AddStep("Address", []fsm.NodeName{"Print"}, count("Address", "Print"))
+	label.AddStep("Print", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		runs["Print"]++
+		ec.SetOutput("label.pdf")
+		return "", nil
+	})
+
+	shipment := fsm.NewStepMap()
+	shipment.AddStep("Pack", []fsm.NodeName{"Label"}, count("Pack", "Label"))
+	shipment.AddSubGraph("Label", fsm.SubGraph{Graph: "Label", OnComplete: "Ship", OutputKey: "label"})
+	shipment.AddStep("Ship", nil, count("Ship", ""))
+
+	if err := h.Executor.AddControlGraph("Label", label); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Executor.AddControlGraph("Shipment", shipment); err != nil {
+		t.Fatal(err)
+	}
+
+	// process has crashed while the child job was executing its last step
+	parent, err := h.Repository.CreateJob(storage.ObjectDTO{CommandGraph: "Shipment", Status: storage.Processing})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parentId := parent.ID.(string)
+	_ = h.Repository.CheckinJob(parentId, "Pack")
+	_ = h.Repository.CheckinJob(parentId, "Label")
+
+	child, err := h.Repository.CreateJob(storage.ObjectDTO{
+		CommandGraph: "Label",
+		Status:       storage.Processing,
+		ParentId:     parentId,
+		ParentStep:   "Label",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	childId := child.ID.(string)
+	_ = h.Repository.AddChild(parentId, childId)
+	_ = h.Repository.CheckinJob(childId, "Address")
+	_ = h.Repository.CheckinJob(childId, "Print")
+
+	recovered, err := h.Executor.RecoverJobs()
+
+	if err != nil || recovered != 1 {
+		t.Fatalf("%d jobs were recovered: %v", recovered, err)
+	}
+
+	// recovered parent is delivered to executor, child job isn't
+	if id := <-h.Executor.ExecutorChannel; id != parentId {
+		t.Fatalf("job %s was delivered instead of %s", id, parentId)
+	}
+
+	if err := h.Executor.RunJob(parentId); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := h.Repository.FindById(parentId)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if obj.Status != storage.Completed || len(obj.Children) != 1 || obj.State["label"] != "label.pdf" {
+		t.Fatalf("job has %s status, children %v and state %v", obj.Status, obj.Children, obj.State)
+	}
+
+	if runs["Pack"] != 0 || runs["Address"] != 0 || runs["Print"] != 1 || runs["Ship"] != 1 {
+		t.Fatalf("steps were executed %v times", runs)
+	}
+}
@@ -0,0 +1,115 @@
+package fsm
+
+import (
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+	"github.com/pkg/errors"
+	"log"
+	"time"
+)
+
+// Scheduler delivers parked job back to executor at given time, it has to survive process restarts
+type Scheduler interface {
+	Schedule(jobId string, priority storage.Priority, at time.Time) error
+}
+
+// Clock tells current time to timers and signal timeouts
+type Clock func() time.Time
+
+var (
+	// errSuspended stops graph execution without finishing the job, job is parked in storage and resumed later
+	errSuspended = errors.New("job is suspended")
+	// errSkipped means that delivered job can't be executed now
+	errSkipped = errors.New("job is skipped")
+)
+
+// SetScheduler sets scheduler which is used by ContinueAfter and ContinueAt,
+// it must be called before StartProcessing
+func (e *Executor) SetScheduler(scheduler Scheduler) {
+	e.scheduler = scheduler
+}
+
+// SetClock replaces system clock, so tests can move time of timers forward,
+// it must be called before StartProcessing
+func (e *Executor) SetClock(clock Clock) {
+	e.clock = clock
+}
+
+// ContinueAfter parks job after the step and continues it from node after given duration,
+// so waiting job doesn't hold executor. Step should return its result.
+func (ec *ExecutionContext) ContinueAfter(node NodeName, duration time.Duration) NodeName {
+	return ec.ContinueAt(node, ec.now().Add(duration))
+}
+
+// ContinueAt parks job after the step and continues it from node at given time,
+// so waiting job doesn't hold executor. Step should return its result.
+func (ec *ExecutionContext) ContinueAt(node NodeName, at time.Time) NodeName {
+	ec.wakeAt = at
+	return node
+}
+
+// now reads executor's clock, execution context created outside of executor uses system clock
+func (ec *ExecutionContext) now() time.Time {
+	if ec.clock == nil {
+		return time.Now()
+	}
+
+	return ec.clock()
+}
+
+// wait parks job until given time
+func (e *Executor) wait(node NodeName, at time.Time, execCont *ExecutionContext) error {
+	if execCont.Branch != "" || execCont.child {
+		return errors.Errorf("job can't wait for %s inside of fan out branch or sub graph", node)
+	}
+
+	if e.scheduler == nil {
+		return errors.Errorf("job can't wait for %s without scheduler", node)
+	}
+
+	// job has to be parked before it's scheduled, otherwise it may be delivered in processing state
+	if err := e.storage.WaitJob(execCont.JobId, string(node), at); err != nil {
+		return errors.Wrapf(err, "couldn't park job before %s", node)
+	}
+
+	if err := e.scheduler.Schedule(execCont.JobId, execCont.priority, at); err != nil {
+		return errors.Wrapf(err, "couldn't schedule job to %s", node)
+	}
+
+	return errSuspended
+}
+
+// deliverable tells whether delivered job may be executed now. Waiting job delivered before its time
+// is scheduled again, since scheduler may deliver it early. Stale timer of the job is scheduled again too,
+// extra delivery is skipped once the job is claimed. The rest of statuses means that job is either
+// executed or finished already.
+func (e *Executor) deliverable(job *storage.Object) bool {
+	switch job.Status {
+	case storage.Initial, storage.Queued:
+		return true
+	case storage.Waiting:
+		// job waits for signal without timeout
+		if job.WakeAt.IsZero() {
+			return false
+		}
+
+		if e.clock().Before(job.WakeAt) {
+			e.reschedule(job)
+			return false
+		}
+
+		return true
+	default:
+		return false
+	}
+}
+
+// reschedule delivers waiting job again at its time, so early delivery doesn't lose the timer
+func (e *Executor) reschedule(job *storage.Object) {
+	if e.scheduler == nil {
+		return
+	}
+
+	if err := e.scheduler.Schedule(job.ID.(string), job.Priority, job.WakeAt); err != nil {
+		log.Printf("Couldn't reschedule job %s delivered before %s: %v", job.ID, job.WakeAt, err)
+	}
+}
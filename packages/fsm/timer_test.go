@@ -0,0 +1,168 @@
+package fsm_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/fsmtest"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+func TestContinueAfter(t *testing.T) {
+	h := fsmtest.New(t)
+	runs := make(map[fsm.NodeName]int)
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Remind", []fsm.NodeName{"Expire"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		runs["Remind"]++
+		return ec.ContinueAfter("Expire", time.Hour), nil
+	})
+	sm.AddStep("Expire", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		runs["Expire"]++
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Reminder", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Reminder", nil).AssertStatus(storage.Waiting)
+
+	if obj := job.Object(); obj.CurrentStep != "Expire" {
+		t.Fatalf("job continues from %s", obj.CurrentStep)
+	}
+
+	// early delivery is skipped and scheduled again, both timers deliver the job once it's due
+	if err := h.Executor.RunJob(job.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	job.AssertStatus(storage.Waiting).Advance(time.Minute * 59).AssertStatus(storage.Waiting)
+	job.Advance(time.Minute).AssertStatus(storage.Completed)
+
+	if runs["Remind"] != 1 || runs["Expire"] != 1 {
+		t.Fatalf("steps were executed %v times", runs)
+	}
+}
+
+// scheduleRecorder keeps schedule requests instead of delivering them
+type scheduleRecorder struct {
+	mux       sync.Mutex
+	scheduled []time.Time
+}
+
+func (sr *scheduleRecorder) Schedule(_ string, _ storage.Priority, at time.Time) error {
+	sr.mux.Lock()
+	defer sr.mux.Unlock()
+
+	sr.scheduled = append(sr.scheduled, at)
+
+	return nil
+}
+
+func TestEarlyDeliveryIsRescheduled(t *testing.T) {
+	repository := fsmtest.NewStorage()
+	scheduler := &scheduleRecorder{}
+	now := time.Now().Truncate(time.Millisecond)
+
+	executor := fsm.NewExecutor(repository, &sync.Map{}, 1)
+	executor.SetScheduler(scheduler)
+	executor.SetClock(func() time.Time {
+		return now
+	})
+
+	wakeAt := now.Add(time.Minute)
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Remind", []fsm.NodeName{"Expire"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return ec.ContinueAt("Expire", wakeAt), nil
+	})
+	sm.AddStep("Expire", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := executor.AddControlGraph("Reminder", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := repository.CreateJob(storage.ObjectDTO{CommandGraph: "Reminder", Status: storage.Initial})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := job.ID.(string)
+
+	if err := executor.RunJob(id); err != nil {
+		t.Fatal(err)
+	}
+
+	// queue has delivered the job a bit before its time
+	now = wakeAt.Add(-time.Millisecond)
+
+	if err := executor.RunJob(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(scheduler.scheduled) != 2 || !scheduler.scheduled[0].Equal(wakeAt) || !scheduler.scheduled[1].Equal(wakeAt) {
+		t.Fatalf("job was scheduled at %v", scheduler.scheduled)
+	}
+
+	now = wakeAt
+
+	if err := executor.RunJob(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if obj, _ := repository.FindById(id); obj.Status != storage.Completed {
+		t.Fatalf("job has %s status", obj.Status)
+	}
+}
+
+func TestContinueAfterWithoutScheduler(t *testing.T) {
+	repository := fsmtest.NewStorage()
+	executor := fsm.NewExecutor(repository, &sync.Map{}, 1)
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Remind", []fsm.NodeName{"Expire"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return ec.ContinueAfter("Expire", time.Hour), nil
+	})
+	sm.AddStep("Expire", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := executor.AddControlGraph("Reminder", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := repository.CreateJob(storage.ObjectDTO{CommandGraph: "Reminder", Status: storage.Initial})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := executor.RunJob(job.ID.(string)); err == nil {
+		t.Fatal("job has waited without scheduler")
+	}
+}
+
+func TestWaitInsideFanOut(t *testing.T) {
+	h := fsmtest.New(t)
+
+	sm := fsm.NewStepMap()
+	sm.AddFanOut("Split", []fsm.NodeName{"Sleep"}, "Join", fsm.JoinAll)
+	sm.AddStep("Sleep", []fsm.NodeName{"Join"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return ec.ContinueAfter("Join", time.Hour), nil
+	})
+	sm.AddStep("Join", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Sleepy", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Run("Sleepy", nil).AssertStatus(storage.Failed)
+}
@@ -0,0 +1,22 @@
+package fsm
+
+import "github.com/pkg/errors"
+
+// End is the explicit terminal marker, step which returns it finishes the job in any mode
+const End NodeName = ""
+
+var ErrInvalidTransition = errors.New("invalid transition")
+
+// SetStrictTransitions enables strict transitions for every graph, see GraphOptions.StrictTransitions.
+// It must be called before StartProcessing.
+func (e *Executor) SetStrictTransitions(strict bool) {
+	e.strictTransitions = strict
+}
+
+func checkTransition(node NodeName, nm nodeMap, next NodeName) error {
+	if next == End || nm.children.Has(next) {
+		return nil
+	}
+
+	return errors.Wrapf(ErrInvalidTransition, "step %s returned %q which isn't among its children %s", node, next, nm.children)
+}
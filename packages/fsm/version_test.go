@@ -0,0 +1,69 @@
+package fsm_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/fsmtest"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+func TestJobPinnedToVersion(t *testing.T) {
+	h := fsmtest.New(t)
+
+	// every version waits a day before sending email with its own template
+	register := func(version string, template string) {
+		sm := fsm.NewStepMap()
+		sm.AddStep("Wait", []fsm.NodeName{"Email"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+			return ec.ContinueAfter("Email", time.Hour*24), nil
+		})
+		sm.AddStep("Email", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+			ec.SetOutput(template)
+			return "", nil
+		})
+
+		if err := h.Executor.AddControlGraphWithOptions("Onboarding", sm, fsm.GraphOptions{Version: version}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	register("v1", "welcome")
+
+	early := h.Run("Onboarding", nil).AssertStatus(storage.Waiting)
+
+	if version := early.Object().GraphVersion; version != "v1" {
+		t.Fatalf("job is pinned to version %q", version)
+	}
+
+	register("v2", "welcome-aboard")
+
+	late := h.Run("Onboarding", nil).AssertStatus(storage.Waiting)
+	explicit := h.RunJob(storage.ObjectDTO{CommandGraph: "Onboarding", GraphVersion: "v1"}).AssertStatus(storage.Waiting)
+
+	h.Advance(time.Hour * 24)
+
+	early.AssertStatus(storage.Completed).AssertOutput("welcome")
+	late.AssertStatus(storage.Completed).AssertOutput("welcome-aboard")
+	explicit.AssertStatus(storage.Completed).AssertOutput("welcome")
+}
+
+func TestUnknownGraphVersion(t *testing.T) {
+	h := fsmtest.New(t)
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Email", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraphWithOptions("Onboarding", sm, fsm.GraphOptions{Version: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.RunJob(storage.ObjectDTO{CommandGraph: "Onboarding", GraphVersion: "v3"}).AssertStatus(storage.Failed)
+
+	if job.Err == nil || !strings.Contains(job.Err.Error(), `"v3"`) {
+		t.Fatalf("job has failed with %v", job.Err)
+	}
+}
@@ -0,0 +1,328 @@
+// Package fsmtest runs control graphs in tests without mongodb, redis, queue and receiver.
+// Jobs are executed synchronously against in-memory storage, so their outcome is known
+// as soon as Run returns. Timers are scheduled on fake clock, which is moved with Advance.
+package fsmtest
+
+import (
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Harness owns executor with in-memory storage, graphs are registered directly on Executor
+type Harness struct {
+	t            testing.TB
+	Executor     *fsm.Executor
+	Repository   *storage.Repository
+	Dependencies *sync.Map
+	scheduler    *scheduler
+}
+
+// timer is job scheduled by executor to be delivered at given time
+type timer struct {
+	jobId string
+	at    time.Time
+}
+
+// scheduler keeps timers until fake clock reaches them
+type scheduler struct {
+	mux    sync.Mutex
+	now    time.Time
+	timers []timer
+}
+
+func (s *scheduler) Schedule(jobId string, _ storage.Priority, at time.Time) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.timers = append(s.timers, timer{jobId: jobId, at: at})
+
+	return nil
+}
+
+func (s *scheduler) clock() time.Time {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.now
+}
+
+// advance moves clock forward and takes due timers out in order of their time
+func (s *scheduler) advance(d time.Duration) []timer {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.now = s.now.Add(d)
+
+	sort.SliceStable(s.timers, func(i, j int) bool {
+		return s.timers[i].at.Before(s.timers[j].at)
+	})
+
+	due := 0
+	for due < len(s.timers) && !s.timers[due].at.After(s.now) {
+		due++
+	}
+
+	fired := s.timers[:due:due]
+	s.timers = s.timers[due:]
+
+	return fired
+}
+
+// NewStorage creates empty in-memory storage without snapshots
+func NewStorage() *storage.Repository {
+	ms, err := storage.NewMemoryStorage(storage.MemoryConfig{})
+
+	if err != nil {
+		panic(err)
+	}
+
+	return storage.NewRepository(ms)
+}
+
+func New(t testing.TB) *Harness {
+	repository := NewStorage()
+	dependencies := &sync.Map{}
+	// storage keeps time in milliseconds, so clock starts with the time job reads back
+	scheduler := &scheduler{now: time.Now().Truncate(time.Millisecond)}
+
+	executor := fsm.NewExecutor(repository, dependencies, 1)
+	executor.SetScheduler(scheduler)
+	executor.SetClock(scheduler.clock)
+
+	return &Harness{
+		t:            t,
+		Executor:     executor,
+		Repository:   repository,
+		Dependencies: dependencies,
+		scheduler:    scheduler,
+	}
+}
+
+// Now returns time of the fake clock timers are scheduled on
+func (h *Harness) Now() time.Time {
+	return h.scheduler.clock()
+}
+
+// Advance moves fake clock forward and executes jobs whose timers are due, in order of their time.
+// It returns error of every executed job by job id, which is nil if job was completed or suspended.
+func (h *Harness) Advance(d time.Duration) map[string]error {
+	errs := make(map[string]error)
+
+	for _, timer := range h.scheduler.advance(d) {
+		err := h.Executor.RunJob(timer.jobId)
+
+		// job may have several timers due, extra deliveries are skipped and shouldn't hide its error
+		if _, ok := errs[timer.jobId]; !ok || err != nil {
+			errs[timer.jobId] = err
+		}
+	}
+
+	return errs
+}
+
+// Mock replaces execution dependency steps get from ExecutionDependencies
+func (h *Harness) Mock(key interface{}, dependency interface{}) *Harness {
+	h.Dependencies.Store(key, dependency)
+	return h
+}
+
+// Run creates job of the latest graph version with given params and executes it
+func (h *Harness) Run(graph string, params map[string]interface{}) *Job {
+	if params == nil {
+		params = make(map[string]interface{})
+	}
+
+	return h.RunJob(storage.ObjectDTO{
+		CommandGraph: graph,
+		Params:       params,
+	})
+}
+
+// RunJob creates job described by dto and executes it, job status is always initial
+func (h *Harness) RunJob(dto storage.ObjectDTO) *Job {
+	h.t.Helper()
+
+	dto.Status = storage.Initial
+	obj, err := h.Repository.CreateJob(dto)
+
+	if err != nil {
+		h.t.Fatalf("couldn't create job of graph %s: %v", dto.CommandGraph, err)
+	}
+
+	job := &Job{
+		h:  h,
+		ID: obj.ID.(string),
+	}
+	job.Err = h.Executor.RunJob(job.ID)
+
+	return job
+}
+
+// Job is executed job, its assertions read job back from storage
+type Job struct {
+	h  *Harness
+	ID string
+	// Err is the error job has failed with, nil if job was completed or suspended
+	Err error
+}
+
+// Object reads job back from storage
+func (j *Job) Object() *storage.Object {
+	j.h.t.Helper()
+
+	obj, err := j.h.Repository.FindById(j.ID)
+
+	if err != nil {
+		j.h.t.Fatalf("couldn't find job %s: %v", j.ID, err)
+	}
+
+	return obj
+}
+
+// Path returns nodes job went through outside of fan out branches
+func (j *Job) Path() []fsm.NodeName {
+	j.h.t.Helper()
+
+	path := make([]fsm.NodeName, 0)
+
+	for _, checkin := range j.Object().Checkins {
+		if checkin.Branch == "" {
+			path = append(path, fsm.NodeName(checkin.Step))
+		}
+	}
+
+	return path
+}
+
+// Signal delivers signal job waits for and executes it again
+func (j *Job) Signal(name string, payload map[string]interface{}) *Job {
+	j.h.t.Helper()
+
+	ok, err := j.h.Repository.DeliverSignal(j.ID, name, payload)
+
+	if err != nil {
+		j.h.t.Fatalf("couldn't deliver signal %s to job %s: %v", name, j.ID, err)
+	}
+
+	if !ok {
+		j.h.t.Fatalf("job %s doesn't wait for signal %s", j.ID, name)
+	}
+
+	j.Err = j.h.Executor.RunJob(j.ID)
+
+	return j
+}
+
+// Advance moves fake clock forward and executes jobs whose timers are due, see Harness.Advance
+func (j *Job) Advance(d time.Duration) *Job {
+	errs := j.h.Advance(d)
+
+	if err, ok := errs[j.ID]; ok {
+		j.Err = err
+	}
+
+	return j
+}
+
+// AssertPath checks exact sequence of nodes job went through outside of fan out branches
+func (j *Job) AssertPath(nodes ...fsm.NodeName) *Job {
+	j.h.t.Helper()
+
+	path := j.Path()
+
+	if !equalPath(path, nodes) {
+		j.h.t.Errorf("job %s went through %v, expected %v", j.ID, path, nodes)
+	}
+
+	return j
+}
+
+// AssertStatus checks final status of the job
+func (j *Job) AssertStatus(status storage.Status) *Job {
+	j.h.t.Helper()
+
+	obj := j.Object()
+
+	if obj.Status != status {
+		j.h.t.Errorf("job %s has %s status, expected %s, error: %q", j.ID, obj.Status, status, obj.Error)
+	}
+
+	return j
+}
+
+// AssertCheckins checks exact sequence of checkins of the job including fan out branches,
+// checkin timestamps are ignored. Checkins of concurrent branches are interleaved nondeterministically,
+// so they are better checked with AssertBranchPath.
+func (j *Job) AssertCheckins(checkins ...storage.CheckinObj) *Job {
+	j.h.t.Helper()
+
+	actual := j.Object().Checkins
+	matched := len(actual) == len(checkins)
+
+	for i := 0; matched && i < len(actual); i++ {
+		matched = actual[i].Step == checkins[i].Step && actual[i].Branch == checkins[i].Branch
+	}
+
+	if !matched {
+		j.h.t.Errorf("job %s has checkins %v, expected %v", j.ID, actual, checkins)
+	}
+
+	return j
+}
+
+// AssertBranchPath checks exact sequence of nodes job went through inside of fan out branch
+func (j *Job) AssertBranchPath(branch fsm.NodeName, nodes ...fsm.NodeName) *Job {
+	j.h.t.Helper()
+
+	path := make([]fsm.NodeName, 0)
+
+	for _, checkin := range j.Object().Checkins {
+		if checkin.Branch == string(branch) {
+			path = append(path, fsm.NodeName(checkin.Step))
+		}
+	}
+
+	if !equalPath(path, nodes) {
+		j.h.t.Errorf("branch %s of job %s went through %v, expected %v", branch, j.ID, path, nodes)
+	}
+
+	return j
+}
+
+// AssertOutput checks output job has set with SetOutput
+func (j *Job) AssertOutput(output interface{}) *Job {
+	j.h.t.Helper()
+
+	expected, err := storage.Normalize(output)
+
+	if err != nil {
+		j.h.t.Fatalf("couldn't compare output: %v", err)
+	}
+
+	actual := j.Object().Output
+
+	if !reflect.DeepEqual(actual, expected) {
+		j.h.t.Errorf("job %s has output %v, expected %v", j.ID, actual, expected)
+	}
+
+	return j
+}
+
+func equalPath(actual []fsm.NodeName, expected []fsm.NodeName) bool {
+	if len(actual) != len(expected) {
+		return false
+	}
+
+	for i := range actual {
+		if actual[i] != expected[i] {
+			return false
+		}
+	}
+
+	return true
+}
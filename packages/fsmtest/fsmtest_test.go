@@ -0,0 +1,141 @@
+package fsmtest_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/fsmtest"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+)
+
+func TestRunAndSignal(t *testing.T) {
+	h := fsmtest.New(t).Mock("greeting", "hello")
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Start", []fsm.NodeName{"Split"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		greeting, _ := ec.ExecutionDependencies.Load("greeting")
+		ec.SetState("greeting", greeting)
+		return "Split", nil
+	})
+	sm.AddFanOut("Split", []fsm.NodeName{"Left", "Right"}, "Join", fsm.JoinAll)
+	sm.AddStep("Left", []fsm.NodeName{"Join"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "Join", nil
+	})
+	sm.AddStep("Right", []fsm.NodeName{"Join"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "Join", nil
+	})
+	sm.AddStep("Join", []fsm.NodeName{"Approved"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return ec.AwaitSignal(fsm.SignalWait{Name: "approve", Node: "Approved"}), nil
+	})
+	sm.AddStep("Approved", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		greeting, _ := ec.GetState("greeting")
+		approver, _ := ec.GetState("approver")
+		ec.SetOutput(map[string]interface{}{"greeting": greeting, "approver": approver})
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Approval", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Approval", nil).
+		AssertStatus(storage.Waiting).
+		AssertPath("Start", "Split", "Join").
+		AssertBranchPath("Left", "Left").
+		AssertBranchPath("Right", "Right")
+
+	job.Signal("approve", map[string]interface{}{"approver": "alice"}).
+		AssertStatus(storage.Completed).
+		AssertPath("Start", "Split", "Join", "Approved").
+		AssertOutput(map[string]interface{}{"greeting": "hello", "approver": "alice"})
+
+	if job.Err != nil {
+		t.Fatalf("job has failed: %v", job.Err)
+	}
+}
+
+func TestFailedJob(t *testing.T) {
+	h := fsmtest.New(t)
+	errDeclined := errors.New("declined")
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Charge", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", errDeclined
+	})
+
+	if err := h.Executor.AddControlGraph("Payment", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	job := h.Run("Payment", nil).
+		AssertStatus(storage.Failed).
+		AssertCheckins(storage.CheckinObj{Step: "Charge"})
+
+	if !errors.Is(job.Err, errDeclined) {
+		t.Fatalf("job has failed with %v, expected %v", job.Err, errDeclined)
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	h := fsmtest.New(t)
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Remind", []fsm.NodeName{"Expire"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return ec.ContinueAfter("Expire", time.Hour), nil
+	})
+	sm.AddStep("Expire", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Reminder", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	started := h.Now()
+	job := h.Run("Reminder", nil).AssertStatus(storage.Waiting)
+
+	if wakeAt := job.Object().WakeAt; !wakeAt.Equal(started.Add(time.Hour)) {
+		t.Fatalf("job wakes at %v, expected %v", wakeAt, started.Add(time.Hour))
+	}
+
+	job.Advance(time.Minute * 59).AssertStatus(storage.Waiting).AssertPath("Remind")
+	job.Advance(time.Minute).AssertStatus(storage.Completed).AssertPath("Remind", "Expire")
+
+	if errs := h.Advance(time.Hour); len(errs) != 0 {
+		t.Fatalf("finished job was executed again: %v", errs)
+	}
+}
+
+func TestAdvanceFiresTimersInOrder(t *testing.T) {
+	h := fsmtest.New(t)
+	order := make([]string, 0)
+
+	sm := fsm.NewStepMap()
+	sm.AddStep("Sleep", []fsm.NodeName{"Wake"}, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		delay, _ := ec.GetParam("delay")
+		return ec.ContinueAfter("Wake", time.Duration(delay.(int))*time.Minute), nil
+	})
+	sm.AddStep("Wake", nil, func(ec *fsm.ExecutionContext) (fsm.NodeName, error) {
+		order = append(order, ec.JobId)
+		return "", nil
+	})
+
+	if err := h.Executor.AddControlGraph("Sleeper", sm); err != nil {
+		t.Fatal(err)
+	}
+
+	late := h.Run("Sleeper", map[string]interface{}{"delay": 30})
+	early := h.Run("Sleeper", map[string]interface{}{"delay": 10})
+
+	errs := h.Advance(time.Hour)
+
+	if len(errs) != 2 || errs[late.ID] != nil || errs[early.ID] != nil {
+		t.Fatalf("unexpected outcome of timers: %v", errs)
+	}
+
+	if len(order) != 2 || order[0] != early.ID || order[1] != late.ID {
+		t.Fatalf("jobs woke up in order %v, expected [%s %s]", order, early.ID, late.ID)
+	}
+}
@@ -3,9 +3,12 @@ package queue
 import (
 	"fmt"
 	"github.com/Madamas/fsm-orchestrator/packages/config"
+	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
 	"github.com/gocraft/work"
 	"github.com/pkg/errors"
 	"log"
+	"time"
 )
 
 type Context struct {
@@ -55,22 +58,93 @@ func (c *Context) Handle(job *work.Job) error {
 	return globalErr
 }
 
+// priorityWeights are relative chances of queue to be picked by worker, so low priority queue is picked eventually
+var priorityWeights = map[storage.Priority]uint{
+	storage.HighPriority:   100,
+	storage.NormalPriority: 10,
+	storage.LowPriority:    1,
+}
+
+// JobName returns name of the queue job of given priority, normal priority keeps the base name
+func JobName(name string, priority storage.Priority) string {
+	if priority == "" || priority == storage.NormalPriority {
+		return name
+	}
+
+	return name + "_" + string(priority)
+}
+
 func NewEnqueuer(config config.Enqueuer) *work.Enqueuer {
 	// TODO: add config validation
 	return work.NewEnqueuer(config.QueueNamespace, config.RedisPool)
 }
 
-func NewHandler(config config.Handler) *work.WorkerPool {
+// Scheduler re-enqueues parked jobs, scheduled jobs are kept in redis so they survive restarts
+type Scheduler struct {
+	enqueuer     *work.Enqueuer
+	queueJobName string
+}
+
+// delaySeconds rounds delay up to whole seconds of unix time, since queue adds them to the current
+// unix second. Rounding of the duration would deliver job up to a second early.
+func delaySeconds(at time.Time, now time.Time) int64 {
+	seconds := at.Unix() - now.Unix()
+	if at.Nanosecond() > 0 {
+		seconds++
+	}
+
+	if seconds < 0 {
+		return 0
+	}
+
+	return seconds
+}
+
+func (s *Scheduler) Schedule(jobId string, priority storage.Priority, at time.Time) error {
+	seconds := delaySeconds(at, time.Now())
+
+	// every timer is kept, since unique job would drop new timer while stale one of the same job is pending.
+	// Executor claims job atomically, so extra delivery is skipped.
+	scheduled, err := s.enqueuer.EnqueueIn(JobName(s.queueJobName, priority), seconds, work.Q{
+		"jobId": jobId,
+	})
+
+	if err == nil && scheduled == nil {
+		err = errors.Errorf("job %s wasn't scheduled", jobId)
+	}
+
+	return err
+}
+
+func NewScheduler(config config.Scheduler) fsm.Scheduler {
 	// TODO: add config validation
-	ctx := &Context{
-		executorChannel: config.ExecutorChannel,
+	return &Scheduler{
+		enqueuer:     config.Enqueuer,
+		queueJobName: config.QueueJobName,
 	}
+}
 
-	wp := work.NewWorkerPool(*ctx, config.Concurrency, config.QueueNamespace, config.RedisPool)
-	wp.JobWithOptions(config.QueueJobName, work.JobOptions{
-		MaxFails: 1,
-		SkipDead: true,
-	}, ctx.Handle)
+func NewHandler(config config.Handler) *work.WorkerPool {
+	// TODO: add config validation
+	wp := work.NewWorkerPool(Context{}, config.Concurrency, config.QueueNamespace, config.RedisPool)
+
+	// every priority has its own queue job, so workers pick jobs according to priority weights
+	for _, priority := range storage.Priorities {
+		channel, ok := config.ExecutorChannels[priority]
+		if !ok {
+			channel = config.ExecutorChannel
+		}
+
+		ctx := &Context{
+			executorChannel: channel,
+		}
+
+		wp.JobWithOptions(JobName(config.QueueJobName, priority), work.JobOptions{
+			Priority: priorityWeights[priority],
+			MaxFails: 1,
+			SkipDead: true,
+		}, ctx.Handle)
+	}
 
 	return wp
 }
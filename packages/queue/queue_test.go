@@ -0,0 +1,28 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDelaySeconds(t *testing.T) {
+	now := time.Unix(1000, int64(time.Millisecond*900))
+
+	cases := []struct {
+		at      time.Time
+		seconds int64
+	}{
+		// queue adds delay to unix second, so job is never delivered before its time
+		{at: now.Add(time.Millisecond * 200), seconds: 2},
+		{at: time.Unix(1001, 0), seconds: 1},
+		{at: time.Unix(1000, 0), seconds: 0},
+		{at: now.Add(-time.Hour), seconds: 0},
+		{at: time.Unix(1060, 1), seconds: 61},
+	}
+
+	for _, c := range cases {
+		if seconds := delaySeconds(c.at, now); seconds != c.seconds {
+			t.Errorf("job at %v is delayed by %d seconds, expected %d", c.at, seconds, c.seconds)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/Madamas/fsm-orchestrator/packages/config"
 	"github.com/Madamas/fsm-orchestrator/packages/fsm"
+	"github.com/Madamas/fsm-orchestrator/packages/queue"
 	"github.com/Madamas/fsm-orchestrator/packages/storage"
 	"github.com/gocraft/work"
 	"github.com/gorilla/mux"
@@ -14,22 +15,44 @@ import (
 )
 
 type payload struct {
-	GraphName string                 `json:"graphName"`
-	Params    map[string]interface{} `json:"params"`
+	GraphName      string                 `json:"graphName"`
+	Version        string                 `json:"version"`
+	EntryPoint     string                 `json:"entryPoint"`
+	Priority       storage.Priority       `json:"priority"`
+	IdempotencyKey string                 `json:"idempotencyKey"`
+	Params         map[string]interface{} `json:"params"`
+}
+
+// jobEnqueuer is the part of work.Enqueuer receiver notifies executor with
+type jobEnqueuer interface {
+	Enqueue(jobName string, args map[string]interface{}) (*work.Job, error)
 }
 
 type HandleContext struct {
 	jobStack     fsm.JobStackLister
-	enqueuer     *work.Enqueuer
+	graphs       fsm.GraphExporter
+	canceller    fsm.JobCanceller
+	limits       fsm.LimitLister
+	simulator    fsm.GraphSimulator
+	enqueuer     jobEnqueuer
 	repository   *storage.Repository
 	queueJobName string
 }
 
 func mapObjectDto(payload payload) storage.ObjectDTO {
+	priority := payload.Priority
+	if priority == "" {
+		priority = storage.NormalPriority
+	}
+
 	return storage.ObjectDTO{
-		Status:       storage.Initial,
-		CommandGraph: payload.GraphName,
-		Params:       payload.Params,
+		Status:         storage.Initial,
+		Priority:       priority,
+		CommandGraph:   payload.GraphName,
+		GraphVersion:   payload.Version,
+		EntryPoint:     payload.EntryPoint,
+		IdempotencyKey: payload.IdempotencyKey,
+		Params:         payload.Params,
 	}
 }
 
@@ -51,23 +74,38 @@ func (hc *HandleContext) createJob(r http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	obj, err := hc.repository.CreateJob(mapObjectDto(payload))
-
-	if err != nil {
-		r.WriteHeader(http.StatusInternalServerError)
-		r.Write([]byte(err.Error()))
+	if !payload.Priority.Known() {
+		r.WriteHeader(http.StatusBadRequest)
+		r.Write([]byte(fmt.Sprintf("unknown priority %s, use one of %v", payload.Priority, storage.Priorities)))
 		return
 	}
 
-	err = hc.NotifyContext(obj.ID.(string))
+	obj, created, err := hc.repository.CreateJobOnce(mapObjectDto(payload))
 
 	if err != nil {
 		r.WriteHeader(http.StatusInternalServerError)
 		r.Write([]byte(err.Error()))
-		hc.repository.FailJob(obj.ID.(string), err)
 		return
 	}
 
+	// repeated submission returns existing job, which is enqueued again only if it's still initial,
+	// so retry recovers from failed enqueue and job is claimed once even if it was enqueued twice
+	if created || obj.Status == storage.Initial {
+		err = hc.NotifyContext(obj.ID.(string), obj.Priority)
+
+		if err != nil {
+			r.WriteHeader(http.StatusInternalServerError)
+			r.Write([]byte(err.Error()))
+
+			// job bound to idempotency key is left initial for retry
+			if obj.IdempotencyKey == "" {
+				hc.repository.FailJob(obj.ID.(string), err)
+			}
+
+			return
+		}
+	}
+
 	resp, err := json.Marshal(obj)
 
 	if err != nil {
@@ -106,6 +144,164 @@ func (hc *HandleContext) getJob(r http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (hc *HandleContext) deliverSignal(r http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	jobId := vars["id"]
+	var signalPayload map[string]interface{}
+
+	body, err := ioutil.ReadAll(req.Body)
+
+	if err != nil {
+		r.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, &signalPayload); err != nil {
+			r.WriteHeader(http.StatusBadRequest)
+			r.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	job, err := hc.repository.FindById(jobId)
+
+	if err != nil {
+		r.WriteHeader(http.StatusInternalServerError)
+		r.Write([]byte(err.Error()))
+		return
+	}
+
+	ok, err := hc.repository.DeliverSignal(jobId, vars["name"], signalPayload)
+
+	if errors.Is(err, storage.ErrInvalidPayload) {
+		r.WriteHeader(http.StatusBadRequest)
+		r.Write([]byte(err.Error()))
+		return
+	}
+
+	if err != nil {
+		r.WriteHeader(http.StatusInternalServerError)
+		r.Write([]byte(err.Error()))
+		return
+	}
+
+	if !ok {
+		r.WriteHeader(http.StatusConflict)
+		r.Write([]byte(fmt.Sprintf("job %s doesn't wait for signal %s", jobId, vars["name"])))
+		return
+	}
+
+	if err = hc.NotifyContext(jobId, job.Priority); err != nil {
+		r.WriteHeader(http.StatusInternalServerError)
+		r.Write([]byte(err.Error()))
+		return
+	}
+
+	r.WriteHeader(http.StatusOK)
+}
+
+func (hc *HandleContext) cancelJob(r http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	err := hc.canceller.CancelJob(vars["id"])
+
+	switch {
+	case errors.Is(err, fsm.ErrNotCancellable):
+		r.WriteHeader(http.StatusConflict)
+		r.Write([]byte(err.Error()))
+	case err != nil:
+		r.WriteHeader(http.StatusInternalServerError)
+		r.Write([]byte(err.Error()))
+	default:
+		r.WriteHeader(http.StatusOK)
+	}
+}
+
+func (hc *HandleContext) pauseJob(r http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	jobId := vars["id"]
+
+	job, err := hc.repository.FindById(jobId)
+
+	if err != nil {
+		r.WriteHeader(http.StatusInternalServerError)
+		r.Write([]byte(err.Error()))
+		return
+	}
+
+	switch {
+	case job.ParentId != "":
+		r.WriteHeader(http.StatusConflict)
+		r.Write([]byte(fmt.Sprintf("job %s is executed by its parent %s", jobId, job.ParentId)))
+		return
+	case job.Status != storage.Initial && job.Status != storage.Queued && job.Status != storage.Processing:
+		r.WriteHeader(http.StatusConflict)
+		r.Write([]byte(fmt.Sprintf("job %s can't be paused in %s status", jobId, job.Status)))
+		return
+	}
+
+	ok, err := hc.repository.PauseJob(jobId, job.Status)
+
+	if err != nil {
+		r.WriteHeader(http.StatusInternalServerError)
+		r.Write([]byte(err.Error()))
+		return
+	}
+
+	if !ok {
+		r.WriteHeader(http.StatusConflict)
+		r.Write([]byte(fmt.Sprintf("job %s has changed its status concurrently", jobId)))
+		return
+	}
+
+	r.WriteHeader(http.StatusOK)
+}
+
+func (hc *HandleContext) resumeJob(r http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	jobId := vars["id"]
+
+	job, err := hc.repository.FindById(jobId)
+
+	if err != nil {
+		r.WriteHeader(http.StatusInternalServerError)
+		r.Write([]byte(err.Error()))
+		return
+	}
+
+	if job.Status != storage.Paused && !(job.Status == storage.Processing && job.PauseRequested) {
+		r.WriteHeader(http.StatusConflict)
+		r.Write([]byte(fmt.Sprintf("job %s isn't paused", jobId)))
+		return
+	}
+
+	ok, err := hc.repository.ResumeJob(jobId, job.Status)
+
+	if err != nil {
+		r.WriteHeader(http.StatusInternalServerError)
+		r.Write([]byte(err.Error()))
+		return
+	}
+
+	if !ok {
+		r.WriteHeader(http.StatusConflict)
+		r.Write([]byte(fmt.Sprintf("job %s has changed its status concurrently", jobId)))
+		return
+	}
+
+	// processing job has just kept running
+	if job.Status == storage.Paused {
+		if err = hc.NotifyContext(jobId, job.Priority); err != nil {
+			r.WriteHeader(http.StatusInternalServerError)
+			r.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	r.WriteHeader(http.StatusOK)
+}
+
 func (hc *HandleContext) listJobs(r http.ResponseWriter, req *http.Request) {
 	jobs := hc.jobStack.ListJobs()
 
@@ -120,7 +316,109 @@ func (hc *HandleContext) listJobs(r http.ResponseWriter, req *http.Request) {
 	r.Write(data)
 }
 
-func (hc *HandleContext) NotifyContext(id string) (err error) {
+func (hc *HandleContext) simulateGraph(r http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	var options fsm.SimulationOptions
+
+	body, err := ioutil.ReadAll(req.Body)
+
+	if err != nil {
+		r.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, &options); err != nil {
+			r.WriteHeader(http.StatusBadRequest)
+			r.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	result, err := hc.simulator.Simulate(vars["name"], options)
+
+	switch {
+	case errors.Is(err, fsm.ErrUnknownGraph):
+		r.WriteHeader(http.StatusNotFound)
+		r.Write([]byte(err.Error()))
+		return
+	case err != nil:
+		r.WriteHeader(http.StatusUnprocessableEntity)
+		r.Write([]byte(err.Error()))
+		return
+	}
+
+	data, err := json.Marshal(result)
+
+	if err != nil {
+		r.WriteHeader(http.StatusInternalServerError)
+		r.Write([]byte(err.Error()))
+		return
+	}
+
+	r.Header().Set("Content-Type", "application/json")
+	r.WriteHeader(http.StatusOK)
+	r.Write(data)
+}
+
+func (hc *HandleContext) listLimits(r http.ResponseWriter, req *http.Request) {
+	data, err := json.Marshal(hc.limits.ListLimits())
+
+	if err != nil {
+		r.WriteHeader(http.StatusInternalServerError)
+		r.Write([]byte(err.Error()))
+		return
+	}
+
+	r.Header().Set("Content-Type", "application/json")
+	r.WriteHeader(http.StatusOK)
+	r.Write(data)
+}
+
+func exportFormat(req *http.Request) fsm.ExportFormat {
+	format := req.URL.Query().Get("format")
+
+	if format == "" {
+		return fsm.DotFormat
+	}
+
+	return fsm.ExportFormat(format)
+}
+
+func writeExport(r http.ResponseWriter, data string, err error) {
+	switch {
+	case errors.Is(err, fsm.ErrUnknownFormat):
+		r.WriteHeader(http.StatusBadRequest)
+		r.Write([]byte(err.Error()))
+	case errors.Is(err, fsm.ErrUnknownGraph):
+		r.WriteHeader(http.StatusNotFound)
+		r.Write([]byte(err.Error()))
+	case err != nil:
+		r.WriteHeader(http.StatusInternalServerError)
+		r.Write([]byte(err.Error()))
+	default:
+		r.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		r.WriteHeader(http.StatusOK)
+		r.Write([]byte(data))
+	}
+}
+
+func (hc *HandleContext) exportGraph(r http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	version := req.URL.Query().Get("version")
+
+	data, err := hc.graphs.ExportGraph(vars["name"], version, exportFormat(req))
+	writeExport(r, data, err)
+}
+
+func (hc *HandleContext) exportJobGraph(r http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	data, err := hc.graphs.ExportJobGraph(vars["id"], exportFormat(req))
+	writeExport(r, data, err)
+}
+
+func (hc *HandleContext) NotifyContext(id string, priority storage.Priority) (err error) {
 	defer func() {
 		e := recover()
 		if e != nil {
@@ -128,7 +426,7 @@ func (hc *HandleContext) NotifyContext(id string) (err error) {
 		}
 	}()
 
-	_, err = hc.enqueuer.Enqueue(hc.queueJobName, work.Q{
+	_, err = hc.enqueuer.Enqueue(queue.JobName(hc.queueJobName, priority), work.Q{
 		"jobId": id,
 	})
 
@@ -139,6 +437,10 @@ func CreateHttpListener(config config.HttpListener) http.Server {
 	// TODO: add config validation
 	hc := HandleContext{
 		jobStack:     config.JobStack,
+		graphs:       config.GraphExporter,
+		canceller:    config.JobCanceller,
+		limits:       config.Limits,
+		simulator:    config.Simulator,
 		enqueuer:     config.Enqueuer,
 		repository:   config.Repository,
 		queueJobName: config.QueueJobName,
@@ -148,6 +450,14 @@ func CreateHttpListener(config config.HttpListener) http.Server {
 	router.HandleFunc("/jobs", hc.createJob).Methods("POST")
 	router.HandleFunc("/jobs/list", hc.listJobs).Methods("GET")
 	router.HandleFunc("/jobs/{id}", hc.getJob).Methods("GET")
+	router.HandleFunc("/jobs/{id}/graph", hc.exportJobGraph).Methods("GET")
+	router.HandleFunc("/jobs/{id}/signals/{name}", hc.deliverSignal).Methods("POST")
+	router.HandleFunc("/jobs/{id}/cancel", hc.cancelJob).Methods("POST")
+	router.HandleFunc("/jobs/{id}/pause", hc.pauseJob).Methods("POST")
+	router.HandleFunc("/jobs/{id}/resume", hc.resumeJob).Methods("POST")
+	router.HandleFunc("/graphs/{name}", hc.exportGraph).Methods("GET")
+	router.HandleFunc("/graphs/{name}/simulate", hc.simulateGraph).Methods("POST")
+	router.HandleFunc("/limits", hc.listLimits).Methods("GET")
 
 	return http.Server{
 		Addr:    "0.0.0.0:8086",
@@ -0,0 +1,130 @@
+package receiver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Madamas/fsm-orchestrator/packages/storage"
+	"github.com/gocraft/work"
+)
+
+// fakeEnqueuer records ids of enqueued jobs instead of sending them to redis
+type fakeEnqueuer struct {
+	enqueued []string
+	err      error
+}
+
+func (fe *fakeEnqueuer) Enqueue(jobName string, args map[string]interface{}) (*work.Job, error) {
+	if fe.err != nil {
+		return nil, fe.err
+	}
+
+	fe.enqueued = append(fe.enqueued, args["jobId"].(string))
+
+	return &work.Job{Name: jobName, Args: args}, nil
+}
+
+func newHandleContext(t *testing.T, enqueuer jobEnqueuer) *HandleContext {
+	ms, err := storage.NewMemoryStorage(storage.MemoryConfig{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &HandleContext{
+		enqueuer:     enqueuer,
+		repository:   storage.NewRepository(ms),
+		queueJobName: "job",
+	}
+}
+
+func submit(t *testing.T, hc *HandleContext, body string) (int, *storage.Object) {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	hc.createJob(recorder, httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(body)))
+
+	if recorder.Code != http.StatusOK {
+		return recorder.Code, nil
+	}
+
+	job := new(storage.Object)
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), job); err != nil {
+		t.Fatal(err)
+	}
+
+	return recorder.Code, job
+}
+
+func TestCreateJobWithIdempotencyKey(t *testing.T) {
+	enqueuer := &fakeEnqueuer{}
+	hc := newHandleContext(t, enqueuer)
+	body := `{"graphName": "Order", "idempotencyKey": "order-1"}`
+
+	_, first := submit(t, hc, body)
+	_, second := submit(t, hc, body)
+
+	if first == nil || second == nil || first.ID != second.ID {
+		t.Fatalf("repeated submission has created jobs %v and %v", first, second)
+	}
+
+	// job is still initial, so it's enqueued again in case the first enqueue was lost
+	if len(enqueuer.enqueued) != 2 || enqueuer.enqueued[1] != first.ID {
+		t.Fatalf("jobs %v were enqueued", enqueuer.enqueued)
+	}
+
+	if ok, err := hc.repository.ClaimJob(first.ID.(string), storage.Initial, "Charge"); !ok || err != nil {
+		t.Fatalf("job wasn't claimed: %v", err)
+	}
+
+	_, third := submit(t, hc, body)
+
+	if third == nil || third.ID != first.ID || third.Status != storage.Processing {
+		t.Fatalf("submission of started job has returned %v", third)
+	}
+
+	if len(enqueuer.enqueued) != 2 {
+		t.Fatalf("started job was enqueued again: %v", enqueuer.enqueued)
+	}
+}
+
+func TestCreateJobEnqueueFailure(t *testing.T) {
+	enqueuer := &fakeEnqueuer{err: errors.New("redis is unavailable")}
+	hc := newHandleContext(t, enqueuer)
+
+	if code, _ := submit(t, hc, `{"graphName": "Order", "idempotencyKey": "order-1"}`); code != http.StatusInternalServerError {
+		t.Fatalf("failed enqueue has responded with %d", code)
+	}
+
+	if code, _ := submit(t, hc, `{"graphName": "Order"}`); code != http.StatusInternalServerError {
+		t.Fatalf("failed enqueue has responded with %d", code)
+	}
+
+	// job bound to idempotency key is left for retry, the other one can't be retried
+	for status, count := range map[storage.Status]int{storage.Initial: 1, storage.Failed: 1} {
+		jobs, err := hc.repository.FindByStatus(status)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(jobs) != count {
+			t.Fatalf("%d jobs have %s status", len(jobs), status)
+		}
+	}
+
+	enqueuer.err = nil
+
+	if code, job := submit(t, hc, `{"graphName": "Order", "idempotencyKey": "order-1"}`); code != http.StatusOK || job.Status != storage.Initial {
+		t.Fatalf("retry has responded with %d", code)
+	}
+
+	if len(enqueuer.enqueued) != 1 {
+		t.Fatalf("jobs %v were enqueued", enqueuer.enqueued)
+	}
+}
@@ -0,0 +1,563 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSnapshotInterval is used when snapshot file is configured without interval
+const DefaultSnapshotInterval = time.Second * 10
+
+// MemoryConfig configures in-memory storage, it's snapshotted only if SnapshotFile is set
+type MemoryConfig struct {
+	SnapshotFile string
+	// SnapshotInterval is how often changed storage is written into SnapshotFile,
+	// zero means DefaultSnapshotInterval
+	SnapshotInterval time.Duration
+	// IdempotencyRetention is how long idempotency keys of submitted jobs are kept,
+	// zero means DefaultIdempotencyRetention
+	IdempotencyRetention time.Duration
+}
+
+// MemoryStorage keeps jobs in memory as bson documents, so updates reference fields the same way as in mongodb.
+// It's safe for concurrent use and may be snapshotted into local file.
+type MemoryStorage struct {
+	mux       sync.RWMutex
+	docs      map[string]bson.M
+	keys      map[idempotencyKey]memoryKey
+	retention time.Duration
+
+	snapshotFile string
+	snapshotMux  sync.Mutex
+	dirty        bool
+	stop         chan struct{}
+	stopped      chan struct{}
+}
+
+type idempotencyKey struct {
+	graph string
+	key   string
+}
+
+type memoryKey struct {
+	JobId     string    `bson:"jobId"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+// snapshotRecord is single document of snapshot file, which holds either job or idempotency key
+type snapshotRecord struct {
+	Job   bson.M     `bson:"job,omitempty"`
+	Graph string     `bson:"graph,omitempty"`
+	Key   string     `bson:"key,omitempty"`
+	Bound *memoryKey `bson:"bound,omitempty"`
+}
+
+// NewMemoryStorage creates in-memory storage. If snapshot file is configured, storage is restored from it
+// and snapshotted periodically, Close has to be called to write the last snapshot.
+func NewMemoryStorage(config MemoryConfig) (*MemoryStorage, error) {
+	retention := config.IdempotencyRetention
+	if retention <= 0 {
+		retention = DefaultIdempotencyRetention
+	}
+
+	ms := &MemoryStorage{
+		docs:         make(map[string]bson.M),
+		keys:         make(map[idempotencyKey]memoryKey),
+		retention:    retention,
+		snapshotFile: config.SnapshotFile,
+	}
+
+	if ms.snapshotFile == "" {
+		return ms, nil
+	}
+
+	if err := ms.restore(); err != nil {
+		return nil, errors.Wrapf(err, "couldn't restore snapshot %s", ms.snapshotFile)
+	}
+
+	interval := config.SnapshotInterval
+	if interval <= 0 {
+		interval = DefaultSnapshotInterval
+	}
+
+	ms.stop = make(chan struct{})
+	ms.stopped = make(chan struct{})
+	go ms.snapshotLoop(interval)
+
+	return ms, nil
+}
+
+// toDoc converts value into document with the same types mongodb would give back
+func toDoc(val interface{}) (bson.M, error) {
+	data, err := bson.Marshal(val)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var doc bson.M
+	err = bson.Unmarshal(data, &doc)
+
+	return doc, err
+}
+
+// Normalize converts value into the types it's read back from storage with
+func Normalize(val interface{}) (interface{}, error) {
+	doc, err := toDoc(bson.M{"value": val})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return doc["value"], nil
+}
+
+func lookup(doc bson.M, path string) interface{} {
+	parts := strings.Split(path, ".")
+
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := doc[part].(bson.M)
+
+		if !ok {
+			return nil
+		}
+
+		doc = child
+	}
+
+	return doc[parts[len(parts)-1]]
+}
+
+func assign(doc bson.M, path string, val interface{}) {
+	parts := strings.Split(path, ".")
+
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := doc[part].(bson.M)
+
+		if !ok {
+			child = bson.M{}
+			doc[part] = child
+		}
+
+		doc = child
+	}
+
+	doc[parts[len(parts)-1]] = val
+}
+
+func matches(doc bson.M, filter KV) (bool, error) {
+	for key, val := range filter {
+		expected, err := Normalize(val)
+
+		if err != nil {
+			return false, err
+		}
+
+		if !reflect.DeepEqual(lookup(doc, key), expected) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func toObject(doc bson.M) (*Object, error) {
+	data, err := bson.Marshal(doc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	obj := new(Object)
+	err = bson.Unmarshal(data, obj)
+
+	return obj, err
+}
+
+func (ms *MemoryStorage) Create(obj ObjectDTO) (*Object, error) {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+
+	return ms.create(obj)
+}
+
+// create stores new job, lock has to be held by caller
+func (ms *MemoryStorage) create(obj ObjectDTO) (*Object, error) {
+	job := &Object{
+		ID:             bson.NewObjectId().Hex(),
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+		Status:         obj.Status,
+		Priority:       obj.Priority,
+		CommandGraph:   obj.CommandGraph,
+		GraphVersion:   obj.GraphVersion,
+		EntryPoint:     obj.EntryPoint,
+		IdempotencyKey: obj.IdempotencyKey,
+		Params:         obj.Params,
+		ParentId:       obj.ParentId,
+		ParentStep:     obj.ParentStep,
+	}
+
+	doc, err := toDoc(job)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ms.docs[job.ID.(string)] = doc
+	ms.dirty = true
+
+	return job, nil
+}
+
+// CreateIdempotent checks the key and creates job under the same lock, so there is no race for the key
+func (ms *MemoryStorage) CreateIdempotent(obj ObjectDTO) (*Object, bool, error) {
+	key := idempotencyKey{graph: obj.CommandGraph, key: obj.IdempotencyKey}
+
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+
+	ms.evictKeys()
+
+	if bound, ok := ms.keys[key]; ok {
+		if doc, ok := ms.docs[bound.JobId]; ok {
+			existing, err := toObject(doc)
+			return existing, false, err
+		}
+	}
+
+	created, err := ms.create(obj)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	ms.keys[key] = memoryKey{
+		JobId:     created.ID.(string),
+		CreatedAt: time.Now(),
+	}
+
+	return created, true, nil
+}
+
+// evictKeys drops idempotency keys which are kept longer than retention, so they don't pile up
+// between snapshots. It must be called under write lock.
+func (ms *MemoryStorage) evictKeys() {
+	for key, bound := range ms.keys {
+		if time.Since(bound.CreatedAt) >= ms.retention {
+			delete(ms.keys, key)
+		}
+	}
+}
+
+func (ms *MemoryStorage) FindById(id string) (*Object, error) {
+	ms.mux.RLock()
+	defer ms.mux.RUnlock()
+
+	doc, ok := ms.docs[id]
+
+	if !ok {
+		return nil, errors.Errorf("job %s not found", id)
+	}
+
+	return toObject(doc)
+}
+
+func (ms *MemoryStorage) Find(filter KV) ([]*Object, error) {
+	ms.mux.RLock()
+	defer ms.mux.RUnlock()
+
+	ids := make([]string, 0, len(ms.docs))
+	for id := range ms.docs {
+		ids = append(ids, id)
+	}
+
+	// object ids grow with time, so jobs are returned in order of creation
+	sort.Strings(ids)
+
+	objs := make([]*Object, 0)
+
+	for _, id := range ids {
+		ok, err := matches(ms.docs[id], filter)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		obj, err := toObject(ms.docs[id])
+
+		if err != nil {
+			return nil, err
+		}
+
+		objs = append(objs, obj)
+	}
+
+	return objs, nil
+}
+
+func (ms *MemoryStorage) UpdateById(id string, update KV, operation OperationMap) error {
+	ok, err := ms.UpdateByIdIf(id, nil, update, operation)
+
+	if err == nil && !ok {
+		err = errors.Errorf("job %s not found", id)
+	}
+
+	return err
+}
+
+func (ms *MemoryStorage) UpdateByIdIf(id string, condition KV, update KV, operation OperationMap) (bool, error) {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+
+	doc, ok := ms.docs[id]
+
+	if !ok {
+		return false, nil
+	}
+
+	if ok, err := matches(doc, condition); err != nil || !ok {
+		return false, err
+	}
+
+	// document is replaced only if every value could be converted
+	changed, err := toDoc(doc)
+
+	if err != nil {
+		return false, err
+	}
+
+	for key, val := range update {
+		normalized, err := Normalize(val)
+
+		if err != nil {
+			return false, err
+		}
+
+		assign(changed, key, normalized)
+	}
+
+	for key, values := range operation {
+		if key != AddOperation {
+			return false, errors.Errorf("operation %s is not supported", key)
+		}
+
+		for path, val := range values {
+			normalized, err := Normalize(val)
+
+			if err != nil {
+				return false, err
+			}
+
+			list, _ := lookup(changed, path).([]interface{})
+			assign(changed, path, append(list, normalized))
+		}
+	}
+
+	assign(changed, "updatedAt", time.Now())
+	ms.docs[id] = changed
+	ms.dirty = true
+
+	return true, nil
+}
+
+// Snapshot writes all jobs and retained idempotency keys into snapshot file, file is replaced atomically
+func (ms *MemoryStorage) Snapshot() error {
+	if ms.snapshotFile == "" {
+		return errors.New("snapshot file isn't configured")
+	}
+
+	ms.snapshotMux.Lock()
+	defer ms.snapshotMux.Unlock()
+
+	ms.mux.Lock()
+	records := make([]snapshotRecord, 0, len(ms.docs)+len(ms.keys))
+
+	for _, doc := range ms.docs {
+		records = append(records, snapshotRecord{Job: doc})
+	}
+
+	ms.evictKeys()
+
+	for key, bound := range ms.keys {
+		bound := bound
+		records = append(records, snapshotRecord{Graph: key.graph, Key: key.key, Bound: &bound})
+	}
+
+	ms.dirty = false
+
+	// documents are never changed in place, so they can be encoded without lock
+	ms.mux.Unlock()
+
+	if err := ms.writeSnapshot(records); err != nil {
+		ms.mux.Lock()
+		ms.dirty = true
+		ms.mux.Unlock()
+
+		return errors.Wrapf(err, "couldn't write snapshot %s", ms.snapshotFile)
+	}
+
+	return nil
+}
+
+func (ms *MemoryStorage) writeSnapshot(records []snapshotRecord) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(ms.snapshotFile), filepath.Base(ms.snapshotFile)+".*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+
+	for _, record := range records {
+		data, err := bson.Marshal(record)
+
+		if err == nil {
+			_, err = writer.Write(data)
+		}
+
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	// snapshot has to reach the disk before it replaces the previous one, otherwise crash may leave empty file
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), ms.snapshotFile)
+}
+
+// restore reads snapshot file, which is a sequence of bson documents, missing file means empty storage
+func (ms *MemoryStorage) restore() error {
+	file, err := os.Open(ms.snapshotFile)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	remaining := info.Size()
+
+	for {
+		// every bson document starts with its length, which includes length itself
+		header := make([]byte, 4)
+
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// length is checked before allocation, so corrupted header can't exhaust memory
+		length := int64(binary.LittleEndian.Uint32(header))
+
+		if length < 5 || length > remaining {
+			return errors.Errorf("corrupted document length %d, %d bytes are left", length, remaining)
+		}
+
+		remaining -= length
+
+		data := make([]byte, length)
+		copy(data, header)
+
+		if _, err := io.ReadFull(reader, data[4:]); err != nil {
+			return err
+		}
+
+		var record snapshotRecord
+
+		if err := bson.Unmarshal(data, &record); err != nil {
+			return err
+		}
+
+		switch {
+		case record.Job != nil:
+			id, _ := record.Job["_id"].(string)
+			ms.docs[id] = record.Job
+		case record.Bound != nil:
+			ms.keys[idempotencyKey{graph: record.Graph, key: record.Key}] = *record.Bound
+		}
+	}
+}
+
+func (ms *MemoryStorage) snapshotLoop(interval time.Duration) {
+	defer close(ms.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ms.mux.RLock()
+			dirty := ms.dirty
+			ms.mux.RUnlock()
+
+			if !dirty {
+				continue
+			}
+
+			if err := ms.Snapshot(); err != nil {
+				log.Printf("Couldn't snapshot storage into %s: %v", ms.snapshotFile, err)
+			}
+		case <-ms.stop:
+			return
+		}
+	}
+}
+
+// Close stops periodic snapshots and writes the last one, storage without snapshot file isn't affected
+func (ms *MemoryStorage) Close() error {
+	if ms.stop == nil {
+		return nil
+	}
+
+	close(ms.stop)
+	<-ms.stopped
+	ms.stop = nil
+
+	return ms.Snapshot()
+}
@@ -0,0 +1,331 @@
+package storage
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func newMemoryRepository(t *testing.T, config MemoryConfig) (*Repository, *MemoryStorage) {
+	t.Helper()
+
+	ms, err := NewMemoryStorage(config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewRepository(ms), ms
+}
+
+func snapshotFile(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "snapshot")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return filepath.Join(dir, "jobs.snapshot")
+}
+
+func TestCreateJobOnce(t *testing.T) {
+	repository, _ := newMemoryRepository(t, MemoryConfig{})
+	dto := ObjectDTO{CommandGraph: "Order", IdempotencyKey: "order-1", Status: Initial}
+
+	first, created, err := repository.CreateJobOnce(dto)
+
+	if err != nil || !created {
+		t.Fatalf("job wasn't created: %v", err)
+	}
+
+	repeated, created, err := repository.CreateJobOnce(dto)
+
+	if err != nil || created || repeated.ID != first.ID {
+		t.Fatalf("repeated submission has created job %v: %v", repeated.ID, err)
+	}
+
+	// key is bound to the graph, so another graph may use it too
+	dto.CommandGraph = "Refund"
+	other, created, err := repository.CreateJobOnce(dto)
+
+	if err != nil || !created || other.ID == first.ID {
+		t.Fatalf("job of another graph wasn't created: %v", err)
+	}
+
+	dto.IdempotencyKey = ""
+	withoutKey, _, _ := repository.CreateJobOnce(dto)
+	again, created, err := repository.CreateJobOnce(dto)
+
+	if err != nil || !created || again.ID == withoutKey.ID {
+		t.Fatalf("job without key wasn't created: %v", err)
+	}
+}
+
+func TestCreateJobOnceExpiredKey(t *testing.T) {
+	repository, ms := newMemoryRepository(t, MemoryConfig{IdempotencyRetention: time.Millisecond * 10})
+	dto := ObjectDTO{CommandGraph: "Order", IdempotencyKey: "order-1", Status: Initial}
+
+	first, _, err := repository.CreateJobOnce(dto)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 20)
+
+	dto.IdempotencyKey = "order-2"
+	if _, _, err := repository.CreateJobOnce(dto); err != nil {
+		t.Fatal(err)
+	}
+
+	// expired keys are evicted on submission, not only on snapshot
+	ms.mux.RLock()
+	keys := len(ms.keys)
+	ms.mux.RUnlock()
+
+	if keys != 1 {
+		t.Fatalf("%d idempotency keys are kept", keys)
+	}
+
+	dto.IdempotencyKey = "order-1"
+	renewed, created, err := repository.CreateJobOnce(dto)
+
+	if err != nil || !created || renewed.ID == first.ID {
+		t.Fatalf("job with expired key wasn't created: %v", err)
+	}
+}
+
+func TestCreateJobOnceConcurrently(t *testing.T) {
+	repository, _ := newMemoryRepository(t, MemoryConfig{})
+	dto := ObjectDTO{CommandGraph: "Order", IdempotencyKey: "order-1", Status: Initial}
+
+	var (
+		wg      sync.WaitGroup
+		mux     sync.Mutex
+		created int
+		ids     = make(map[interface{}]bool)
+	)
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			job, ok, err := repository.CreateJobOnce(dto)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			mux.Lock()
+			defer mux.Unlock()
+
+			ids[job.ID] = true
+			if ok {
+				created++
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if created != 1 || len(ids) != 1 {
+		t.Fatalf("%d jobs were created, %d distinct jobs were returned", created, len(ids))
+	}
+}
+
+func TestMemorySnapshot(t *testing.T) {
+	file := snapshotFile(t)
+	ms, err := NewMemoryStorage(MemoryConfig{SnapshotFile: file, SnapshotInterval: time.Millisecond * 20})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repository := NewRepository(ms)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			job, err := repository.CreateJob(ObjectDTO{Status: Initial, CommandGraph: "Payment", Params: map[string]interface{}{"amount": 1}})
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			id := job.ID.(string)
+			_ = repository.CheckinJob(id, "Reserve")
+			_ = repository.CheckinJob(id, "Charge")
+			_ = repository.CompleteJob(id)
+		}()
+	}
+
+	wg.Wait()
+
+	keyed, created, err := repository.CreateJobOnce(ObjectDTO{CommandGraph: "Payment", IdempotencyKey: "order-1"})
+
+	if err != nil || !created {
+		t.Fatalf("keyed job wasn't created: %v", err)
+	}
+
+	if err := ms.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewMemoryStorage(MemoryConfig{SnapshotFile: file})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer restored.Close()
+
+	jobs, err := restored.Find(KV{"status": Completed})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 50 || len(jobs[0].Checkins) != 2 || jobs[0].Checkins[1].Step != "Charge" {
+		t.Fatalf("%d jobs were restored, the first one is %+v", len(jobs), jobs[0])
+	}
+
+	again, created, err := NewRepository(restored).CreateJobOnce(ObjectDTO{CommandGraph: "Payment", IdempotencyKey: "order-1"})
+
+	if err != nil || created || again.ID != keyed.ID {
+		t.Fatalf("idempotency key wasn't restored: %v", err)
+	}
+}
+
+func TestRestoreCorruptedSnapshot(t *testing.T) {
+	document, err := bson.Marshal(snapshotRecord{Job: bson.M{"_id": "1", "status": Completed}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := func(length uint32) []byte {
+		data := make([]byte, 4)
+		binary.LittleEndian.PutUint32(data, length)
+		return data
+	}
+
+	cases := map[string][]byte{
+		"header shorter than itself": header(3),
+		"empty document":             header(4),
+		"header beyond file":         append(header(1<<32-1), document...),
+		"truncated document":         document[:len(document)-1],
+		"truncated header":           document[:2],
+		"garbage after document":     append(append([]byte{}, document...), header(0)...),
+	}
+
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			file := snapshotFile(t)
+
+			if err := ioutil.WriteFile(file, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if ms, err := NewMemoryStorage(MemoryConfig{SnapshotFile: file}); err == nil {
+				ms.Close()
+				t.Fatal("corrupted snapshot was restored")
+			}
+		})
+	}
+
+	file := snapshotFile(t)
+
+	if err := ioutil.WriteFile(file, document, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ms, err := NewMemoryStorage(MemoryConfig{SnapshotFile: file})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ms.Close()
+
+	if job, err := ms.FindById("1"); err != nil || job.Status != Completed {
+		t.Fatalf("valid snapshot wasn't restored: %v", err)
+	}
+}
+
+func TestMemoryUpdate(t *testing.T) {
+	ms, err := NewMemoryStorage(MemoryConfig{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := ms.Create(ObjectDTO{Status: Initial, CommandGraph: "Payment"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := job.ID.(string)
+
+	ok, err := ms.UpdateByIdIf(id, KV{"status": Processing}, KV{"status": Completed}, nil)
+
+	if err != nil || ok {
+		t.Fatalf("job was updated in unexpected status: %v", err)
+	}
+
+	ok, err = ms.UpdateByIdIf(id, KV{"status": Initial}, KV{"status": Processing, "state.total": 42}, nil)
+
+	if err != nil || !ok {
+		t.Fatalf("job wasn't updated: %v", err)
+	}
+
+	updated, err := ms.FindById(id)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updated.Status != Processing || updated.State["total"] != 42 {
+		t.Fatalf("job has %s status and state %v", updated.Status, updated.State)
+	}
+
+	if err := ms.UpdateById("missing", KV{"status": Completed}, nil); err == nil {
+		t.Fatal("missing job was updated")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	normalized, err := Normalize(map[string]interface{}{"amount": int64(5), "items": []string{"a"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, ok := normalized.(bson.M)
+
+	if !ok {
+		t.Fatalf("map was normalized into %T", normalized)
+	}
+
+	if _, ok := doc["items"].([]interface{}); !ok {
+		t.Fatalf("slice was normalized into %T", doc["items"])
+	}
+}
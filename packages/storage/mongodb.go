@@ -1,7 +1,6 @@
 package storage
 
 import (
-	"github.com/Madamas/fsm-orchestrator/packages/config"
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/pkg/errors"
@@ -9,10 +8,21 @@ import (
 	"time"
 )
 
+// MongodbConfig configures connection to mongodb and collection jobs are kept in
+type MongodbConfig struct {
+	Url              string
+	Database         string
+	Table            string
+	ReconnectTimeout time.Duration
+	// IdempotencyRetention is how long idempotency keys of submitted jobs are kept,
+	// zero means DefaultIdempotencyRetention
+	IdempotencyRetention time.Duration
+}
+
 // connection struct is barebone implementation that contains all that you need
 // for simple work with mongodb
 type connection struct {
-	Config         config.MongodbConfig
+	Config         MongodbConfig
 	db             *mgo.Database
 	session        *mgo.Session
 	isConnected    bool
@@ -90,7 +100,7 @@ func closeSession(session *mgo.Session) {
 	session.Close()
 }
 
-func connect(cfg config.MongodbConfig) (*mgo.Session, error) {
+func connect(cfg MongodbConfig) (*mgo.Session, error) {
 	info, err := mgo.ParseURL(cfg.Url)
 	if err != nil {
 		return nil, err
@@ -102,7 +112,7 @@ func connect(cfg config.MongodbConfig) (*mgo.Session, error) {
 	return mgo.DialWithInfo(info)
 }
 
-func reconnect(cfg config.MongodbConfig) (*mgo.Session, error) {
+func reconnect(cfg MongodbConfig) (*mgo.Session, error) {
 	for i := 0; ; i++ {
 		session, err := connect(cfg)
 
@@ -114,7 +124,7 @@ func reconnect(cfg config.MongodbConfig) (*mgo.Session, error) {
 	}
 }
 
-func Connect(config config.MongodbConfig) (*connection, error) {
+func Connect(config MongodbConfig) (*connection, error) {
 	session, err := connect(config)
 
 	if err != nil {
@@ -128,22 +138,70 @@ func Connect(config config.MongodbConfig) (*connection, error) {
 	}, nil
 }
 
-func NewMongoStorage(config config.MongodbConfig) (*Repository, error) {
+func NewMongoStorage(config MongodbConfig) (*Repository, error) {
 	conn, err := Connect(config)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return NewRepository(&MongoStorage{
-		conn: conn,
-		name: config.Table,
-	}), nil
+	retention := config.IdempotencyRetention
+	if retention <= 0 {
+		retention = DefaultIdempotencyRetention
+	}
+
+	ms := &MongoStorage{
+		conn:      conn,
+		name:      config.Table,
+		retention: retention,
+	}
+
+	if err := ms.ensureKeysIndex(); err != nil {
+		return nil, err
+	}
+
+	return NewRepository(ms), nil
 }
 
 type MongoStorage struct {
-	conn *connection
-	name string
+	conn      *connection
+	name      string
+	retention time.Duration
+}
+
+// idempotencyKeyObj binds idempotency key to the job, its id is unique pair of graph and key
+type idempotencyKeyObj struct {
+	ID        bson.D        `bson:"_id"`
+	JobId     bson.ObjectId `bson:"jobId"`
+	CreatedAt time.Time     `bson:"createdAt"`
+}
+
+func (ms *MongoStorage) keysName() string {
+	return ms.name + "_idempotency_keys"
+}
+
+// ensureKeysIndex makes mongodb remove expired idempotency keys, index is rebuilt if retention was changed
+func (ms *MongoStorage) ensureKeysIndex() error {
+	keys, err := ms.conn.GetCollection(ms.keysName())
+
+	if err != nil {
+		return err
+	}
+
+	index := mgo.Index{
+		Key:         []string{"createdAt"},
+		ExpireAfter: ms.retention,
+	}
+
+	if err := keys.EnsureIndex(index); err == nil {
+		return nil
+	}
+
+	if err := keys.DropIndex("createdAt"); err != nil {
+		return errors.Wrap(err, "couldn't drop index of idempotency keys")
+	}
+
+	return errors.Wrap(keys.EnsureIndex(index), "couldn't create index of idempotency keys")
 }
 
 func parseID(id string) (bson.ObjectId, error) {
@@ -161,12 +219,18 @@ func (ms *MongoStorage) Create(obj ObjectDTO) (*Object, error) {
 	}
 
 	job := &Object{
-		ID:           bson.NewObjectId(),
-		CreatedAt:    time.Now(),
-		UpdatedAt:    time.Now(),
-		Status:       obj.Status,
-		CommandGraph: obj.CommandGraph,
-		Params:       obj.Params,
+		ID:             bson.NewObjectId(),
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+		Status:         obj.Status,
+		Priority:       obj.Priority,
+		CommandGraph:   obj.CommandGraph,
+		GraphVersion:   obj.GraphVersion,
+		EntryPoint:     obj.EntryPoint,
+		IdempotencyKey: obj.IdempotencyKey,
+		Params:         obj.Params,
+		ParentId:       obj.ParentId,
+		ParentStep:     obj.ParentStep,
 	}
 	if err = collection.Insert(job); err != nil {
 		return nil, err
@@ -177,6 +241,69 @@ func (ms *MongoStorage) Create(obj ObjectDTO) (*Object, error) {
 	return job, nil
 }
 
+// CreateIdempotent creates job first and binds its key afterwards, so the key never points to missing job.
+// Job which lost the race for the key is removed before anyone could see it.
+func (ms *MongoStorage) CreateIdempotent(obj ObjectDTO) (*Object, bool, error) {
+	collection, err := ms.conn.GetCollection(ms.name)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	keys, err := ms.conn.GetCollection(ms.keysName())
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	keyId := bson.D{{Name: "graph", Value: obj.CommandGraph}, {Name: "key", Value: obj.IdempotencyKey}}
+
+	// ttl monitor removes expired keys only once a minute
+	err = keys.Remove(bson.M{
+		"_id":       keyId,
+		"createdAt": bson.M{"$lt": time.Now().Add(-ms.retention)},
+	})
+
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, false, err
+	}
+
+	job, err := ms.Create(obj)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	jobId := bson.ObjectIdHex(job.ID.(string))
+	err = keys.Insert(idempotencyKeyObj{
+		ID:        keyId,
+		JobId:     jobId,
+		CreatedAt: time.Now(),
+	})
+
+	if err == nil {
+		return job, true, nil
+	}
+
+	if removeErr := collection.RemoveId(jobId); removeErr != nil {
+		return nil, false, errors.Wrapf(removeErr, "couldn't remove duplicate job %s", job.ID)
+	}
+
+	if !mgo.IsDup(err) {
+		return nil, false, err
+	}
+
+	var key idempotencyKeyObj
+
+	if err := keys.FindId(keyId).One(&key); err != nil {
+		return nil, false, err
+	}
+
+	existing, err := ms.FindById(key.JobId.Hex())
+
+	return existing, false, err
+}
+
 func (ms *MongoStorage) FindById(id string) (*Object, error) {
 	bsonId, err := parseID(id)
 
@@ -201,6 +328,26 @@ func (ms *MongoStorage) FindById(id string) (*Object, error) {
 	return obj, nil
 }
 
+func (ms *MongoStorage) Find(filter KV) ([]*Object, error) {
+	collection, err := ms.conn.GetCollection(ms.name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var objs []*Object
+
+	if err := collection.Find(bson.M(filter)).All(&objs); err != nil {
+		return nil, err
+	}
+
+	for _, obj := range objs {
+		obj.ID = obj.ID.(bson.ObjectId).Hex()
+	}
+
+	return objs, nil
+}
+
 func operationMapper(operation OperationKey) string {
 	switch operation {
 	case AddOperation:
@@ -210,6 +357,25 @@ func operationMapper(operation OperationKey) string {
 	}
 }
 
+func updateChange(update KV, operation OperationMap) bson.M {
+	if update == nil {
+		update = KV{}
+	}
+	update["updatedAt"] = time.Now()
+
+	change := bson.M{
+		"$set": update,
+	}
+
+	if operation != nil {
+		for key, val := range operation {
+			change[operationMapper(key)] = val
+		}
+	}
+
+	return change
+}
+
 func (ms *MongoStorage) UpdateById(id string, update KV, operation OperationMap) error {
 	bsonId, err := parseID(id)
 
@@ -223,23 +389,41 @@ func (ms *MongoStorage) UpdateById(id string, update KV, operation OperationMap)
 		return err
 	}
 
-	if update == nil {
-		update = KV{}
+	if err := collection.UpdateId(bsonId, updateChange(update, operation)); err != nil {
+		return err
 	}
-	update["updatedAt"] = time.Now()
+	return nil
+}
 
-	change := bson.M{
-		"$set": update,
+func (ms *MongoStorage) UpdateByIdIf(id string, condition KV, update KV, operation OperationMap) (bool, error) {
+	bsonId, err := parseID(id)
+
+	if err != nil {
+		return false, err
 	}
 
-	if operation != nil {
-		for key, val := range operation {
-			change[operationMapper(key)] = val
-		}
+	collection, err := ms.conn.GetCollection(ms.name)
+
+	if err != nil {
+		return false, err
 	}
 
-	if err := collection.UpdateId(bsonId, change); err != nil {
-		return err
+	selector := bson.M{
+		"_id": bsonId,
 	}
-	return nil
+
+	for key, val := range condition {
+		selector[key] = val
+	}
+
+	err = collection.Update(selector, updateChange(update, operation))
+
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
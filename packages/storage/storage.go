@@ -1,35 +1,105 @@
 package storage
 
 import (
+	"github.com/pkg/errors"
+	"strings"
 	"time"
 )
 
 type Status string
 
 var (
-	Initial    Status = "initial"
-	Processing Status = "processing"
-	Completed  Status = "completed"
-	Failed     Status = "failed"
+	Initial     Status = "initial"
+	Processing  Status = "processing"
+	Completed   Status = "completed"
+	Failed      Status = "failed"
+	TimedOut    Status = "timedOut"
+	Interrupted Status = "interrupted"
+	Waiting     Status = "waiting"
+	// Queued job is resumed from its current step on next delivery
+	Queued Status = "queued"
+	// Compensated and CompensationFailed replace failed status after compensation steps were executed,
+	// they are kept as compensation status of jobs which timed out or were cancelled
+	Compensated        Status = "compensated"
+	CompensationFailed Status = "compensationFailed"
+	// Cancelled job was stopped on request, it may be compensated afterwards
+	Cancelled Status = "cancelled"
+	// Paused job is frozen between steps until it's resumed
+	Paused Status = "paused"
 )
 
+// Priority tells which jobs are taken first, empty priority is treated as NormalPriority
+type Priority string
+
+var (
+	HighPriority   Priority = "high"
+	NormalPriority Priority = "normal"
+	LowPriority    Priority = "low"
+)
+
+// Priorities lists known priorities from the highest to the lowest one
+var Priorities = []Priority{HighPriority, NormalPriority, LowPriority}
+
+// Known tells whether priority is one of Priorities, empty one is known as well
+func (p Priority) Known() bool {
+	if p == "" {
+		return true
+	}
+
+	for _, known := range Priorities {
+		if p == known {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Update operations must reference this fields by their json tag
 type Object struct {
-	ID           interface{}            `bson:"_id" json:"id"`
-	CreatedAt    time.Time              `bson:"createdAt" json:"createdAt"`
-	UpdatedAt    time.Time              `bson:"updatedAt" json:"updatedAt"`
-	CompletedAt  time.Time              `bson:"completedAt" json:"completedAt"`
-	Error        string                 `bson:"error" json:"error"`
-	CurrentStep  string                 `bson:"currentStep" json:"currentStep"`
-	CommandGraph string                 `bson:"commandGraph" json:"commandGraph"`
-	Status       Status                 `bson:"status" json:"status"`
-	Params       map[string]interface{} `bson:"params" json:"params"`
+	ID                 interface{}            `bson:"_id" json:"id"`
+	CreatedAt          time.Time              `bson:"createdAt" json:"createdAt"`
+	UpdatedAt          time.Time              `bson:"updatedAt" json:"updatedAt"`
+	CompletedAt        time.Time              `bson:"completedAt" json:"completedAt"`
+	Error              string                 `bson:"error" json:"error"`
+	CurrentStep        string                 `bson:"currentStep" json:"currentStep"`
+	CommandGraph       string                 `bson:"commandGraph" json:"commandGraph"`
+	GraphVersion       string                 `bson:"graphVersion" json:"graphVersion"`
+	EntryPoint         string                 `bson:"entryPoint" json:"entryPoint"`
+	IdempotencyKey     string                 `bson:"idempotencyKey" json:"idempotencyKey"`
+	WakeAt             time.Time              `bson:"wakeAt" json:"wakeAt"`
+	Deadline           time.Time              `bson:"deadline" json:"deadline"`
+	AwaitedSignal      string                 `bson:"awaitedSignal" json:"awaitedSignal"`
+	SignalTimeoutStep  string                 `bson:"signalTimeoutStep" json:"signalTimeoutStep"`
+	Status             Status                 `bson:"status" json:"status"`
+	Priority           Priority               `bson:"priority" json:"priority"`
+	CancelRequested    bool                   `bson:"cancelRequested" json:"cancelRequested"`
+	PauseRequested     bool                   `bson:"pauseRequested" json:"pauseRequested"`
+	Params             map[string]interface{} `bson:"params" json:"params"`
+	Checkins           []CheckinObj           `bson:"step" json:"checkins"`
+	Attempts           []AttemptObj           `bson:"attempts" json:"attempts"`
+	Branches           map[string]BranchObj   `bson:"branches" json:"branches"`
+	State              map[string]interface{} `bson:"state" json:"state"`
+	Output             interface{}            `bson:"output" json:"output"`
+	CompletedSteps     []string               `bson:"completedSteps" json:"completedSteps"`
+	Compensations      []CompensationObj      `bson:"compensations" json:"compensations"`
+	CompensationStatus Status                 `bson:"compensationStatus" json:"compensationStatus"`
+	CompensationError  string                 `bson:"compensationError" json:"compensationError"`
+	ParentId           string                 `bson:"parentId" json:"parentId"`
+	ParentStep         string                 `bson:"parentStep" json:"parentStep"`
+	Children           []string               `bson:"children" json:"children"`
 }
 
 type ObjectDTO struct {
-	CommandGraph string                 `bson:"commandGraph" json:"commandGraph"`
-	Status       Status                 `bson:"status" json:"status"`
-	Params       map[string]interface{} `bson:"params" json:"params"`
+	CommandGraph   string                 `bson:"commandGraph" json:"commandGraph"`
+	GraphVersion   string                 `bson:"graphVersion" json:"graphVersion"`
+	EntryPoint     string                 `bson:"entryPoint" json:"entryPoint"`
+	IdempotencyKey string                 `bson:"idempotencyKey" json:"idempotencyKey"`
+	Status         Status                 `bson:"status" json:"status"`
+	Priority       Priority               `bson:"priority" json:"priority"`
+	Params         map[string]interface{} `bson:"params" json:"params"`
+	ParentId       string                 `bson:"parentId" json:"parentId"`
+	ParentStep     string                 `bson:"parentStep" json:"parentStep"`
 }
 
 type KV map[string]interface{}
@@ -40,19 +110,52 @@ const (
 	AddOperation OperationKey = "add"
 )
 
+// DefaultIdempotencyRetention is used when retention of idempotency keys isn't configured
+const DefaultIdempotencyRetention = time.Hour * 24
+
 type OperationValue map[string]interface{}
 type OperationMap map[OperationKey]OperationValue
 
 // Storage provides easy to provide minimalistic approach to abstract persistent storage.
 // Update operation receives map of fields which corresponds to object's json field tags by name.
+// Find operation receives map of fields with their exact values in the same manner.
+// Conditional update is applied only if object matches condition, which is given in the same manner as well.
+// Idempotent creation atomically returns existing object with the same idempotency key and graph instead of creating
+// new one, as long as the key is retained.
 type Storage interface {
 	Create(obj ObjectDTO) (*Object, error)
+	CreateIdempotent(obj ObjectDTO) (job *Object, created bool, err error)
 	FindById(id string) (*Object, error)
+	Find(filter KV) ([]*Object, error)
 	UpdateById(id string, update KV, operation OperationMap) error
+	UpdateByIdIf(id string, condition KV, update KV, operation OperationMap) (bool, error)
 }
 
 type CheckinObj struct {
 	Step      string    `bson:"step" json:"step"`
+	Branch    string    `bson:"branch,omitempty" json:"branch,omitempty"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+}
+
+// BranchObj holds state of single fan out branch, keyed by branch's first node
+type BranchObj struct {
+	Status      Status `bson:"status" json:"status"`
+	CurrentStep string `bson:"currentStep" json:"currentStep"`
+	Error       string `bson:"error" json:"error"`
+}
+
+// AttemptObj records single invocation of a step with retry policy
+type AttemptObj struct {
+	Step      string    `bson:"step" json:"step"`
+	Attempt   int       `bson:"attempt" json:"attempt"`
+	Error     string    `bson:"error" json:"error"`
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+}
+
+// CompensationObj records execution of single compensation step
+type CompensationObj struct {
+	Step      string    `bson:"step" json:"step"`
+	Error     string    `bson:"error" json:"error"`
 	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
 }
 
@@ -72,6 +175,22 @@ func (r *Repository) CreateJob(obj ObjectDTO) (*Object, error) {
 	return r.Create(obj)
 }
 
+// CreateJobOnce creates job, unless job with the same idempotency key was already created for the graph
+func (r *Repository) CreateJobOnce(obj ObjectDTO) (*Object, bool, error) {
+	if obj.IdempotencyKey == "" {
+		job, err := r.Create(obj)
+		return job, err == nil, err
+	}
+
+	return r.CreateIdempotent(obj)
+}
+
+func (r *Repository) FindByStatus(status Status) ([]*Object, error) {
+	return r.Find(KV{
+		"status": status,
+	})
+}
+
 func (r *Repository) CheckinJob(id string, step string) error {
 	update := KV{
 		"currentStep": step,
@@ -89,6 +208,171 @@ func (r *Repository) CheckinJob(id string, step string) error {
 	return r.UpdateById(id, update, operations)
 }
 
+func branchField(branch string, field string) string {
+	return "branches." + branch + "." + field
+}
+
+func (r *Repository) CheckinBranch(id string, branch string, step string) error {
+	update := KV{
+		branchField(branch, "currentStep"): step,
+	}
+
+	operations := OperationMap{
+		AddOperation: OperationValue{
+			"step": CheckinObj{
+				Step:      step,
+				Branch:    branch,
+				Timestamp: time.Now(),
+			},
+		},
+	}
+
+	return r.UpdateById(id, update, operations)
+}
+
+func (r *Repository) StartBranch(id string, branch string) error {
+	data := KV{
+		branchField(branch, "status"):      Processing,
+		branchField(branch, "currentStep"): branch,
+	}
+
+	return r.UpdateById(id, data, nil)
+}
+
+func (r *Repository) FailBranch(id string, branch string, err error) error {
+	data := KV{
+		branchField(branch, "status"): Failed,
+		branchField(branch, "error"):  err.Error(),
+	}
+
+	return r.UpdateById(id, data, nil)
+}
+
+func (r *Repository) CompleteBranch(id string, branch string) error {
+	data := KV{
+		branchField(branch, "status"): Completed,
+	}
+
+	return r.UpdateById(id, data, nil)
+}
+
+func (r *Repository) RecordAttempt(id string, step string, attempt int, err error) error {
+	record := AttemptObj{
+		Step:      step,
+		Attempt:   attempt,
+		Timestamp: time.Now(),
+	}
+
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	operations := OperationMap{
+		AddOperation: OperationValue{
+			"attempts": record,
+		},
+	}
+
+	return r.UpdateById(id, nil, operations)
+}
+
+func (r *Repository) SaveState(id string, state map[string]interface{}, output interface{}) error {
+	data := KV{
+		"state":  state,
+		"output": output,
+	}
+
+	return r.UpdateById(id, data, nil)
+}
+
+func (r *Repository) CompleteStep(id string, step string) error {
+	operations := OperationMap{
+		AddOperation: OperationValue{
+			"completedSteps": step,
+		},
+	}
+
+	return r.UpdateById(id, nil, operations)
+}
+
+func (r *Repository) RecordCompensation(id string, step string, err error) error {
+	record := CompensationObj{
+		Step:      step,
+		Timestamp: time.Now(),
+	}
+
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	operations := OperationMap{
+		AddOperation: OperationValue{
+			"compensations": record,
+		},
+	}
+
+	return r.UpdateById(id, nil, operations)
+}
+
+// FinishCompensation records outcome of compensation. Only failed status is replaced with it,
+// so timed out and cancelled jobs keep telling why they were stopped.
+func (r *Repository) FinishCompensation(id string, err error) error {
+	data := KV{
+		"compensationStatus": Compensated,
+	}
+
+	if err != nil {
+		data["compensationStatus"] = CompensationFailed
+		data["compensationError"] = err.Error()
+	}
+
+	condition := KV{
+		"status": Failed,
+	}
+
+	replaced := KV{
+		"status": data["compensationStatus"],
+	}
+
+	for key, val := range data {
+		replaced[key] = val
+	}
+
+	ok, updErr := r.UpdateByIdIf(id, condition, replaced, nil)
+
+	if updErr != nil || ok {
+		return updErr
+	}
+
+	return r.UpdateById(id, data, nil)
+}
+
+func (r *Repository) AddChild(id string, childId string) error {
+	operations := OperationMap{
+		AddOperation: OperationValue{
+			"children": childId,
+		},
+	}
+
+	return r.UpdateById(id, nil, operations)
+}
+
+func (r *Repository) PinGraphVersion(id string, version string) error {
+	data := KV{
+		"graphVersion": version,
+	}
+
+	return r.UpdateById(id, data, nil)
+}
+
+func (r *Repository) SetDeadline(id string, deadline time.Time) error {
+	data := KV{
+		"deadline": deadline,
+	}
+
+	return r.UpdateById(id, data, nil)
+}
+
 func (r *Repository) StartJob(id string, step string) error {
 	data := KV{
 		"status":      Processing,
@@ -98,6 +382,164 @@ func (r *Repository) StartJob(id string, step string) error {
 	return r.UpdateById(id, data, nil)
 }
 
+func (r *Repository) WaitJob(id string, step string, wakeAt time.Time) error {
+	data := KV{
+		"status":      Waiting,
+		"currentStep": step,
+		"wakeAt":      wakeAt,
+	}
+
+	return r.UpdateById(id, data, nil)
+}
+
+// ClaimJob atomically moves job from observed status into processing, so it's executed only once.
+// Waiting job may be delivered both by its signal and by its timeout, unconditional StartJob would run it twice.
+func (r *Repository) ClaimJob(id string, status Status, step string) (bool, error) {
+	condition := KV{
+		"status": status,
+	}
+
+	data := KV{
+		"status":        Processing,
+		"currentStep":   step,
+		"awaitedSignal": "",
+	}
+
+	return r.UpdateByIdIf(id, condition, data, nil)
+}
+
+// QueueJob atomically moves job from observed status into queued one
+func (r *Repository) QueueJob(id string, status Status) (bool, error) {
+	condition := KV{
+		"status": status,
+	}
+
+	data := KV{
+		"status": Queued,
+	}
+
+	return r.UpdateByIdIf(id, condition, data, nil)
+}
+
+// AwaitSignal parks job until signal is delivered, zero deadline means that job waits forever
+func (r *Repository) AwaitSignal(id string, signal string, step string, timeoutStep string, deadline time.Time) error {
+	data := KV{
+		"status":            Waiting,
+		"currentStep":       step,
+		"awaitedSignal":     signal,
+		"signalTimeoutStep": timeoutStep,
+		"wakeAt":            deadline,
+	}
+
+	return r.UpdateById(id, data, nil)
+}
+
+// ErrInvalidPayload means that signal payload has key which can't be used as state key
+var ErrInvalidPayload = errors.New("invalid signal payload")
+
+// DeliverSignal merges signal payload into job state and queues job, if it still waits for the signal.
+// Payload keys are state keys, so they can't be empty, contain dots or start with dollar sign.
+func (r *Repository) DeliverSignal(id string, signal string, payload map[string]interface{}) (bool, error) {
+	for key := range payload {
+		if key == "" || strings.Contains(key, ".") || strings.HasPrefix(key, "$") {
+			return false, errors.Wrapf(ErrInvalidPayload, "key %q can't be used as state key", key)
+		}
+	}
+
+	condition := KV{
+		"status":        Waiting,
+		"awaitedSignal": signal,
+	}
+
+	data := KV{
+		"status":        Queued,
+		"awaitedSignal": "",
+	}
+
+	for key, val := range payload {
+		data["state."+key] = val
+	}
+
+	return r.UpdateByIdIf(id, condition, data, nil)
+}
+
+// RequestCancel marks processing job, so it's cancelled by executor which runs it or resumes it after crash
+func (r *Repository) RequestCancel(id string) (bool, error) {
+	condition := KV{
+		"status": Processing,
+	}
+
+	data := KV{
+		"cancelRequested": true,
+	}
+
+	return r.UpdateByIdIf(id, condition, data, nil)
+}
+
+// CancelJob atomically moves job from observed status into cancelled one
+func (r *Repository) CancelJob(id string, status Status, err error) (bool, error) {
+	condition := KV{
+		"status": status,
+	}
+
+	data := KV{
+		"status":        Cancelled,
+		"error":         err.Error(),
+		"awaitedSignal": "",
+	}
+
+	return r.UpdateByIdIf(id, condition, data, nil)
+}
+
+// PauseJob atomically pauses job in observed status. Job which isn't executed at the moment is paused right away,
+// processing one is marked, so executor pauses it at its next checkpoint.
+func (r *Repository) PauseJob(id string, status Status) (bool, error) {
+	condition := KV{
+		"status": status,
+	}
+
+	if status == Processing {
+		return r.UpdateByIdIf(id, condition, KV{"pauseRequested": true}, nil)
+	}
+
+	return r.UpdateByIdIf(id, condition, KV{"status": Paused}, nil)
+}
+
+// ResumeJob atomically queues paused job, so it continues from its current step on next delivery.
+// Pause request of processing job which hasn't reached its checkpoint yet is withdrawn.
+func (r *Repository) ResumeJob(id string, status Status) (bool, error) {
+	if status == Processing {
+		condition := KV{
+			"status":         Processing,
+			"pauseRequested": true,
+		}
+
+		return r.UpdateByIdIf(id, condition, KV{"pauseRequested": false}, nil)
+	}
+
+	condition := KV{
+		"status": Paused,
+	}
+
+	return r.UpdateByIdIf(id, condition, KV{"status": Queued}, nil)
+}
+
+// PauseAtCheckpoint pauses processing job before given step, if pause was requested
+func (r *Repository) PauseAtCheckpoint(id string, step string) (bool, error) {
+	condition := KV{
+		"status":         Processing,
+		"pauseRequested": true,
+	}
+
+	data := KV{
+		"status":         Paused,
+		"currentStep":    step,
+		"pauseRequested": false,
+	}
+
+	return r.UpdateByIdIf(id, condition, data, nil)
+}
+
 func (r *Repository) FailJob(id string, err error) error {
 	data := KV{
 		"status": Failed,
@@ -107,6 +549,24 @@ func (r *Repository) FailJob(id string, err error) error {
 	return r.UpdateById(id, data, nil)
 }
 
+func (r *Repository) InterruptJob(id string, err error) error {
+	data := KV{
+		"status": Interrupted,
+		"error":  err.Error(),
+	}
+
+	return r.UpdateById(id, data, nil)
+}
+
+func (r *Repository) TimeoutJob(id string, err error) error {
+	data := KV{
+		"status": TimedOut,
+		"error":  err.Error(),
+	}
+
+	return r.UpdateById(id, data, nil)
+}
+
 func (r *Repository) CompleteJob(id string) error {
 	data := KV{
 		"status":      Completed,